@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/organizations"
+	orgtypes "github.com/aws/aws-sdk-go-v2/service/organizations/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// defaultRoleName is the role assumed in accounts given by id
+const defaultRoleName = "OrganizationAccountAccessRole"
+
+// target is a single account to inspect
+type target struct {
+	Account string     // account id, empty for the account of base config
+	awsCfg  aws.Config // AWS config with credentials of account
+}
+
+// targets returns accounts to inspect: either accounts set by cfg, each with
+// AWS config assuming role in it, or a single target with base config
+func targets(ctx context.Context, awsCfg aws.Config, cfg config) ([]target, error) {
+	accounts := []string(cfg.Accounts)
+	if cfg.AccountsFile != "" {
+		list, err := readAccountsFile(cfg.AccountsFile)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, list...)
+	}
+	var self string // account of base config, it's used as is
+	if cfg.Org {
+		ident, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return nil, err
+		}
+		self = aws.ToString(ident.Account)
+		list, err := orgAccounts(ctx, awsCfg)
+		if err != nil {
+			return nil, fmt.Errorf("listing organization accounts: %w", err)
+		}
+		accounts = append(accounts, list...)
+	}
+	if len(accounts) == 0 {
+		return []target{{awsCfg: awsCfg}}, nil
+	}
+	out := make([]target, 0, len(accounts))
+	stsClient := sts.NewFromConfig(awsCfg)
+	seen := make(map[string]struct{})
+	for _, s := range accounts {
+		roleARN, account, err := roleARN(s, cfg.RoleName)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[account]; ok {
+			continue
+		}
+		seen[account] = struct{}{}
+		if account == self {
+			out = append(out, target{Account: account, awsCfg: awsCfg})
+			continue
+		}
+		accountCfg := awsCfg.Copy()
+		accountCfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, roleARN,
+			func(o *stscreds.AssumeRoleOptions) { o.RoleSessionName = userAgent }))
+		out = append(out, target{Account: account, awsCfg: accountCfg})
+	}
+	return out, nil
+}
+
+// orgAccounts returns ids of active accounts of the organization, it must be
+// called with credentials of management or delegated administrator account
+func orgAccounts(ctx context.Context, awsCfg aws.Config) ([]string, error) {
+	var out []string
+	paginator := organizations.NewListAccountsPaginator(organizations.NewFromConfig(awsCfg), &organizations.ListAccountsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range page.Accounts {
+			if a.Status == orgtypes.AccountStatusActive {
+				out = append(out, aws.ToString(a.Id))
+			}
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// roleARN returns ARN of role to assume and account id for s, which is either
+// role ARN, or account id to assume role with given name in
+func roleARN(s, roleName string) (arn, account string, err error) {
+	if strings.HasPrefix(s, "arn:") {
+		// arn:aws:iam::123456789012:role/Name
+		fields := strings.SplitN(s, ":", 6)
+		if len(fields) != 6 || fields[4] == "" || !strings.HasPrefix(fields[5], "role/") {
+			return "", "", fmt.Errorf("invalid role ARN: %q", s)
+		}
+		return s, fields[4], nil
+	}
+	if len(s) != 12 || strings.Trim(s, "0123456789") != "" {
+		return "", "", fmt.Errorf("invalid account id: %q", s)
+	}
+	if roleName == "" {
+		roleName = defaultRoleName
+	}
+	return "arn:aws:iam::" + s + ":role/" + roleName, s, nil
+}
+
+// readAccountsFile reads account ids or role ARNs from file, one per line.
+// Empty lines and lines starting with # are ignored.
+func readAccountsFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out, sc.Err()
+}
+
+// mergeReports aggregates reports of different accounts, merging reports of
+// the same region by summing counts. Reconciliation is not redone, so
+// reservations of one account are not applied to instances of another.
+func mergeReports(reps []*report) []*report {
+	byRegion := make(map[[2]string]*report) // by service and region
+	var out []*report
+	for _, r := range reps {
+		m, ok := byRegion[[2]string{r.Service, r.Region}]
+		if !ok {
+			m = &report{Service: r.Service, Region: r.Region}
+			byRegion[[2]string{r.Service, r.Region}] = m
+			out = append(out, m)
+		}
+		m.Running += r.Running
+		m.OnDemandInstances = append(m.OnDemandInstances, r.OnDemandInstances...)
+		m.UnusedReservations = append(m.UnusedReservations, r.UnusedReservations...)
+		m.Spot = append(m.Spot, r.Spot...)
+	}
+	for _, m := range out {
+		m.OnDemandInstances = mergeInfos(m.OnDemandInstances)
+		m.UnusedReservations = mergeInfos(m.UnusedReservations)
+		m.Spot = mergeInfos(m.Spot)
+	}
+	sortReports(out)
+	return out
+}
+
+// sortReports sorts aggregated reports by service, then region
+func sortReports(reps []*report) {
+	sort.SliceStable(reps, func(i, j int) bool {
+		if ri, rj := serviceRank(reps[i].Service), serviceRank(reps[j].Service); ri != rj {
+			return ri < rj
+		}
+		return reps[i].Region < reps[j].Region
+	})
+}
+
+// mergeInfos sums counts of items with the same type and AZ, keeping the
+// earliest end date and its payment terms
+func mergeInfos(infos []reservations.Item) []reservations.Item {
+	idx := make(map[reservations.Key]int)
+	var out []reservations.Item
+	for _, v := range infos {
+		k := v.Key()
+		if i, ok := idx[k]; ok {
+			out[i].Count += v.Count
+			out[i].SavingsPlans += v.SavingsPlans
+			if v.End != nil && (out[i].End == nil || v.End.Before(*out[i].End)) {
+				out[i].End, out[i].Offering = v.End, v.Offering
+			}
+			continue
+		}
+		idx[k] = len(out)
+		out = append(out, v)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+	return out
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// asgShortfall warns that desired capacity of Auto Scaling group running a
+// single instance type is above the number of reservations available for it
+type asgShortfall struct {
+	Group    string `json:"group"`
+	Type     string `json:"type"`
+	Platform string `json:"platform,omitempty"`
+	Tenancy  string `json:"tenancy,omitempty"`
+	Desired  int    `json:"desired"`
+	Reserved int    `json:"reserved"` // reservations of the type not used by instances outside the group
+}
+
+// fetchDesiredCapacity returns desired capacity of Auto Scaling groups by
+// group name
+func fetchDesiredCapacity(ctx context.Context, awsCfg aws.Config) (map[string]int, error) {
+	out := make(map[string]int)
+	paginator := autoscaling.NewDescribeAutoScalingGroupsPaginator(autoscaling.NewFromConfig(awsCfg), &autoscaling.DescribeAutoScalingGroupsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range page.AutoScalingGroups {
+			out[aws.ToString(g.AutoScalingGroupName)] = int(aws.ToInt32(g.DesiredCapacity))
+		}
+	}
+	return out, nil
+}
+
+// annotateDesiredCapacity fetches desired capacity of Auto Scaling groups of
+// EC2 reports
+func annotateDesiredCapacity(ctx context.Context, reps []*report) error {
+	for _, rep := range reps {
+		if rep.inv == nil || len(rep.inv.AutoScaling) == 0 {
+			continue
+		}
+		var err error
+		if rep.desired, err = fetchDesiredCapacity(ctx, rep.awsCfg); err != nil {
+			return jobError(rep.Account, rep.Region, err)
+		}
+	}
+	return nil
+}
+
+// splitByASG sets on-demand instances of EC2 reports in res attributed to
+// Auto Scaling groups, see splitByTag, and warns about groups whose desired
+// capacity is above reservations available for their instance type
+func (res *result) splitByASG() {
+	res.split(func(inv *reservations.Inventory) map[string]map[reservations.Key]int { return inv.AutoScaling },
+		func(rep *report, trs []tagReport) { rep.ASGs = trs })
+	for _, rep := range res.Reports {
+		if rep.inv != nil && rep.desired != nil {
+			rep.ASGShortfalls = asgShortfalls(rep, rep.desired)
+		}
+	}
+}
+
+// asgShortfalls returns Auto Scaling groups of rep having desired capacity
+// above the number of reservations available for their type: reservations
+// covering instances of the type or unused, less instances of the type
+// running outside the group. Groups running several types or platforms are
+// skipped, as their future instances can't be told.
+func asgShortfalls(rep *report, desired map[string]int) []asgShortfall {
+	// instance types regardless of AZ
+	typeKey := func(k reservations.Key) reservations.Key {
+		k.AZ = ""
+		return k
+	}
+	running := make(map[reservations.Key]int)
+	for k, n := range rep.inv.Running {
+		running[typeKey(k)] += n
+	}
+	reserved := make(map[reservations.Key]int)
+	for k, n := range running {
+		reserved[k] = n
+	}
+	for _, v := range rep.OnDemandInstances {
+		reserved[typeKey(v.Key())] -= v.Count
+	}
+	for _, v := range rep.UnusedReservations {
+		reserved[typeKey(v.Key())] += v.Count
+	}
+	var out []asgShortfall
+	for name, keys := range rep.inv.AutoScaling {
+		group := make(map[reservations.Key]int)
+		for k, n := range keys {
+			group[typeKey(k)] += n
+		}
+		if len(group) != 1 {
+			continue
+		}
+		for k, n := range group {
+			avail := reserved[k] - (running[k] - n)
+			if avail < 0 {
+				avail = 0
+			}
+			if d, ok := desired[name]; ok && d > avail {
+				out = append(out, asgShortfall{Group: name, Type: k.Type, Platform: k.Platform, Tenancy: k.Tenancy, Desired: d, Reserved: avail})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Group < out[j].Group })
+	return out
+}
+
+func writeASGs(w io.Writer, trs []tagReport, shortfalls []asgShortfall, currency string) {
+	if len(trs) > 0 {
+		fmt.Fprintln(w, "On-demand instances by Auto Scaling group:")
+	}
+	for _, t := range trs {
+		label := t.Value
+		if label == "" {
+			label = "(not in Auto Scaling group)"
+		}
+		writeTagReport(w, label, t, currency)
+	}
+	if len(shortfalls) > 0 {
+		fmt.Fprintln(w, "Auto Scaling groups with desired capacity above reservations:")
+	}
+	for _, s := range shortfalls {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\tdesired %d, %d reserved\n", s.Group, s.Type, s.Platform, s.Tenancy, s.Desired, s.Reserved)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// oneYear is the duration of 1 year reservation term in seconds
+const oneYear = 365 * 24 * 60 * 60
+
+// paymentOptions maps -payment-option values to offering types
+var paymentOptions = map[string]types.OfferingTypeValues{
+	"all-upfront":     types.OfferingTypeValuesAllUpfront,
+	"partial-upfront": types.OfferingTypeValuesPartialUpfront,
+	"no-upfront":      types.OfferingTypeValuesNoUpfront,
+}
+
+// breakEven compares recommended purchase with running the same instances
+// on demand, per instance
+type breakEven struct {
+	Offering     string  `json:"offering"`     // reserved instances offering ID
+	OfferingType string  `json:"offeringType"` // No Upfront, Partial Upfront or All Upfront
+	FixedPrice   float64 `json:"fixedPrice"`
+	Hourly       float64 `json:"hourly"`
+	OnDemandRate float64 `json:"onDemandRate"`
+	Currency     string  `json:"currency"`
+	// Months is the number of months after which upfront payment is paid
+	// off by lower hourly rate, nil if reservation never pays off
+	Months *float64 `json:"months,omitempty"`
+}
+
+// annotateBreakEven sets BreakEven of purchases recommended for rep, using
+// standard 1 year Region-scoped offerings of given type. On-demand instances
+// of rep must be annotated with annotateRates in the same currency, offerings
+// priced in other currency are skipped. Purchases are then ordered by months
+// to break even, ones paying off sooner first.
+func annotateBreakEven(ctx context.Context, svc ec2.DescribeReservedInstancesOfferingsAPIClient, rep *report, ps []purchase, offeringType types.OfferingTypeValues, currency string) error {
+	for i, p := range ps {
+		rate := purchaseRate(rep, p)
+		if rate == 0 {
+			continue
+		}
+		o, err := purchaseOffering(ctx, svc, p, offeringType)
+		if err != nil {
+			return err
+		}
+		if o == nil || !sameCurrency(string(o.CurrencyCode), currency) {
+			continue
+		}
+		be := &breakEven{
+			Offering:     aws.ToString(o.ReservedInstancesOfferingId),
+			OfferingType: string(o.OfferingType),
+			FixedPrice:   float64(aws.ToFloat32(o.FixedPrice)),
+			Hourly:       float64(aws.ToFloat32(o.UsagePrice)),
+			OnDemandRate: rate,
+			Currency:     currency,
+		}
+		for _, c := range o.RecurringCharges {
+			if c.Frequency == types.RecurringChargeFrequencyHourly {
+				be.Hourly += aws.ToFloat64(c.Amount)
+			}
+		}
+		if saved := rate - be.Hourly; saved > 0 {
+			months := be.FixedPrice / (saved * hoursPerMonth)
+			be.Months = &months
+		}
+		ps[i].BreakEven = be
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return breakEvenMonths(ps[i]) < breakEvenMonths(ps[j]) })
+	return nil
+}
+
+// breakEvenMonths returns months to break even for purchase, or +Inf if it's
+// not known or purchase never pays off
+func breakEvenMonths(p purchase) float64 {
+	if p.BreakEven == nil || p.BreakEven.Months == nil {
+		return math.Inf(1)
+	}
+	return *p.BreakEven.Months
+}
+
+// purchaseRate returns hourly on-demand rate of a single instance of
+// purchase type, derived from on-demand instances it covers. Rates of
+// size-flexible purchases are scaled from any size of the family.
+func purchaseRate(rep *report, p purchase) float64 {
+	for _, v := range rep.OnDemandInstances {
+		if v.OnDemandRate == 0 || v.Platform != p.Platform || v.Tenancy != p.Tenancy {
+			continue
+		}
+		if v.Type == p.Type {
+			return v.OnDemandRate
+		}
+		from, to := reservations.SizeUnits(v.Type), reservations.SizeUnits(p.Type)
+		if p.Flexible && from > 0 && to > 0 && reservations.Family(v.Type) == reservations.Family(p.Type) {
+			return v.OnDemandRate * float64(to) / float64(from)
+		}
+	}
+	return 0
+}
+
+// purchaseOffering returns standard 1 year Region-scoped offering for
+// purchase, or nil if there's none
+func purchaseOffering(ctx context.Context, svc ec2.DescribeReservedInstancesOfferingsAPIClient, p purchase, offeringType types.OfferingTypeValues) (*types.ReservedInstancesOffering, error) {
+	input := &ec2.DescribeReservedInstancesOfferingsInput{
+		InstanceType:       types.InstanceType(p.Type),
+		OfferingClass:      types.OfferingClassTypeStandard,
+		OfferingType:       offeringType,
+		ProductDescription: types.RIProductDescription(p.Platform),
+		IncludeMarketplace: aws.Bool(false),
+		MinDuration:        aws.Int64(oneYear),
+		MaxDuration:        aws.Int64(oneYear),
+		Filters: []types.Filter{{
+			Name:   aws.String("scope"),
+			Values: []string{string(types.ScopeRegional)},
+		}},
+	}
+	if input.ProductDescription == "" {
+		input.ProductDescription = reservations.LinuxPlatform
+	}
+	if p.Tenancy != "" {
+		input.InstanceTenancy = types.Tenancy(p.Tenancy)
+	}
+	paginator := ec2.NewDescribeReservedInstancesOfferingsPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.ReservedInstancesOfferings) > 0 {
+			return &page.ReservedInstancesOfferings[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// breakEvenNote returns note on when purchase pays off, if it's known
+func breakEvenNote(p purchase) string {
+	be := p.BreakEven
+	if be == nil {
+		return ""
+	}
+	switch {
+	case be.Months == nil:
+		return fmt.Sprintf(", never breaks even (%s/h vs %s/h on-demand)", money(be.Hourly, be.Currency), money(be.OnDemandRate, be.Currency))
+	case *be.Months == 0:
+		return fmt.Sprintf(", saves from the start (%s)", be.OfferingType)
+	default:
+		return fmt.Sprintf(", breaks even in %.1f months (%s)", *be.Months, be.OfferingType)
+	}
+}
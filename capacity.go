@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// capacityReservation is On-Demand Capacity Reservations of the same instance
+// type, AZ, platform and tenancy, summed. Capacity reserved and not used by
+// instances is billed as if instances were running.
+type capacityReservation struct {
+	Type      string   `json:"type"`
+	AZ        string   `json:"az"`
+	Platform  string   `json:"platform,omitempty"`
+	Tenancy   string   `json:"tenancy,omitempty"`
+	IDs       []string `json:"ids"`
+	Total     int      `json:"total"`     // reserved capacity, in instances
+	Available int      `json:"available"` // capacity not used by instances
+	Running   int      `json:"running"`   // matching running instances, whether they use reservations or not
+}
+
+// key returns key of instances capacity reservation may be used by
+func (c *capacityReservation) key() reservations.Key {
+	return reservations.Key{Type: c.Type, AZ: c.AZ, Platform: c.Platform, Tenancy: c.Tenancy}
+}
+
+// capacityBlock is a Capacity Block for ML, reservation of GPU or Trainium
+// instances for a fixed period paid upfront
+type capacityBlock struct {
+	ID    string    `json:"id"`
+	Type  string    `json:"type"`
+	AZ    string    `json:"az"`
+	Total int       `json:"total"`
+	Used  int       `json:"used"` // instances running in the block
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// capacity is what fetchCapacityReservations returns
+type capacity struct {
+	reservations []capacityReservation // summed per instance type, AZ, platform and tenancy
+	blocks       []capacityBlock
+	fleetInUse   map[string]int // instances using reservations of fleets, by reservation id
+}
+
+// fetchCapacityReservations returns active On-Demand Capacity Reservations
+// and Capacity Blocks selected by opts. Number of instances using
+// reservations of Capacity Reservation Fleets is counted regardless of opts.
+func fetchCapacityReservations(ctx context.Context, svc ec2API, opts reservations.Options) (*capacity, error) {
+	input := &ec2.DescribeCapacityReservationsInput{
+		Filters: []types.Filter{{
+			Name:   aws.String("state"),
+			Values: []string{string(types.CapacityReservationStateActive)},
+		}},
+	}
+	idx := make(map[reservations.Key]int) // index in out
+	var out []capacityReservation
+	res := &capacity{fleetInUse: make(map[string]int)}
+	paginator := ec2.NewDescribeCapacityReservationsPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, cr := range page.CapacityReservations {
+			used := int(aws.ToInt32(cr.TotalInstanceCount) - aws.ToInt32(cr.AvailableInstanceCount))
+			if cr.CapacityReservationFleetId != nil {
+				res.fleetInUse[aws.ToString(cr.CapacityReservationId)] = used
+			}
+			typ, az := aws.ToString(cr.InstanceType), aws.ToString(cr.AvailabilityZone)
+			if !opts.TypeSelected(typ) || len(opts.AZs) > 0 && !commaList(opts.AZs).has(az) {
+				continue
+			}
+			if cr.ReservationType == types.CapacityReservationTypeCapacityBlock {
+				res.blocks = append(res.blocks, capacityBlock{
+					ID:    aws.ToString(cr.CapacityReservationId),
+					Type:  typ,
+					AZ:    az,
+					Total: int(aws.ToInt32(cr.TotalInstanceCount)),
+					Used:  used,
+					Start: aws.ToTime(cr.StartDate),
+					End:   aws.ToTime(cr.EndDate),
+				})
+				continue
+			}
+			c := capacityReservation{Type: typ, AZ: az}
+			if !opts.IgnorePlatform {
+				c.Platform = string(cr.InstancePlatform)
+			}
+			if t := string(cr.Tenancy); t != "default" {
+				c.Tenancy = t
+			}
+			i, ok := idx[c.key()]
+			if !ok {
+				i = len(out)
+				idx[c.key()] = i
+				out = append(out, c)
+			}
+			out[i].IDs = append(out[i].IDs, aws.ToString(cr.CapacityReservationId))
+			out[i].Total += int(aws.ToInt32(cr.TotalInstanceCount))
+			out[i].Available += int(aws.ToInt32(cr.AvailableInstanceCount))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Type != out[j].Type {
+			return out[i].Type < out[j].Type
+		}
+		return out[i].AZ < out[j].AZ
+	})
+	sort.Slice(res.blocks, func(i, j int) bool { return res.blocks[i].End.Before(res.blocks[j].End) })
+	res.reservations = out
+	return res, nil
+}
+
+// capacityFleet is a Capacity Reservation Fleet. Capacity is in units of
+// instance type weights of the fleet.
+type capacityFleet struct {
+	ID        string  `json:"id"`
+	State     string  `json:"state"`
+	Target    int     `json:"target"`
+	Fulfilled float64 `json:"fulfilled"` // capacity reserved
+	Used      float64 `json:"used"`      // capacity used by instances
+}
+
+// overProvisioned reports whether fleet reserves more capacity than used
+func (f *capacityFleet) overProvisioned() bool { return f.Used < f.Fulfilled }
+
+// fetchCapacityFleets returns Capacity Reservation Fleets that are not
+// cancelled or expired, with capacity used calculated from inUse returned by
+// fetchCapacityReservations
+func fetchCapacityFleets(ctx context.Context, svc ec2API, inUse map[string]int) ([]capacityFleet, error) {
+	input := &ec2.DescribeCapacityReservationFleetsInput{
+		Filters: []types.Filter{{
+			Name: aws.String("state"),
+			Values: []string{
+				string(types.CapacityReservationFleetStateActive),
+				string(types.CapacityReservationFleetStatePartiallyFulfilled),
+				string(types.CapacityReservationFleetStateModifying),
+			},
+		}},
+	}
+	var out []capacityFleet
+	paginator := ec2.NewDescribeCapacityReservationFleetsPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range page.CapacityReservationFleets {
+			cf := capacityFleet{
+				ID:        aws.ToString(f.CapacityReservationFleetId),
+				State:     string(f.State),
+				Target:    int(aws.ToInt32(f.TotalTargetCapacity)),
+				Fulfilled: aws.ToFloat64(f.TotalFulfilledCapacity),
+			}
+			for _, spec := range f.InstanceTypeSpecifications {
+				weight := aws.ToFloat64(spec.Weight)
+				if weight == 0 {
+					weight = 1
+				}
+				cf.Used += weight * float64(inUse[aws.ToString(spec.CapacityReservationId)])
+			}
+			out = append(out, cf)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// unusedCapacity returns capacity reservations with available capacity,
+// counting matching running instances of inv
+func unusedCapacity(crs []capacityReservation, inv *reservations.Inventory) []capacityReservation {
+	var out []capacityReservation
+	for _, c := range crs {
+		if c.Available == 0 {
+			continue
+		}
+		c.Running = inv.Running[c.key()]
+		out = append(out, c)
+	}
+	return out
+}
+
+func writeCapacityReservations(w io.Writer, crs []capacityReservation) {
+	if len(crs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Unused capacity reservations:")
+	for _, c := range crs {
+		var note string
+		// running instances that could use available capacity, but don't:
+		// reservation is probably targeted, or instances were launched
+		// with capacity reservation preference set to none
+		if outside := c.Running - (c.Total - c.Available); outside > 0 {
+			note = fmt.Sprintf("\t%d matching instances don't use it", outside)
+		}
+		fmt.Fprintf(w, "%s\t%d of %d\t%s\t%s\t%s%s\n", c.Type, c.Available, c.Total, c.AZ, c.Platform, c.Tenancy, note)
+	}
+}
+
+func writeCapacityBlocks(w io.Writer, blocks []capacityBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Capacity blocks:")
+	for _, b := range blocks {
+		var note string
+		if b.Used == 0 {
+			note = "\tidle"
+		}
+		fmt.Fprintf(w, "%s\t%d of %d used\t%s\t%s\tuntil %s%s\n", b.Type, b.Used, b.Total, b.AZ, b.ID, b.End.Format(time.RFC3339), note)
+	}
+}
+
+func writeCapacityFleets(w io.Writer, fleets []capacityFleet) {
+	if len(fleets) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Capacity reservation fleets (target, fulfilled, used):")
+	for _, f := range fleets {
+		var note string
+		if f.overProvisioned() {
+			note = "\tover-provisioned"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%g\t%g\t%s%s\n", f.ID, f.Target, f.Fulfilled, f.Used, f.State, note)
+	}
+}
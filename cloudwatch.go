@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// maxMetricData is the max number of data points per PutMetricData call
+const maxMetricData = 1000
+
+// publishMetrics publishes counts of uncovered instances and unused
+// reservations of each report as CloudWatch metrics to the account and region
+// report belongs to. Besides per type/AZ metrics, totals with only Service
+// dimension are always published, so that alarms don't see missing data when
+// there's nothing to report.
+func publishMetrics(ctx context.Context, namespace string, res *result) error {
+	for _, rep := range res.Reports {
+		ts := aws.Time(res.Time)
+		service := cwtypes.Dimension{Name: aws.String("Service"), Value: aws.String(rep.service())}
+		var uncovered, unused int
+		var data []cwtypes.MetricDatum
+		for _, v := range rep.OnDemandInstances {
+			uncovered += v.Count
+			data = append(data, metricDatum("UncoveredInstances", service, v, ts))
+		}
+		for _, v := range rep.UnusedReservations {
+			unused += v.Count
+			data = append(data, metricDatum("UnusedReservations", service, v, ts))
+		}
+		data = append(data,
+			cwtypes.MetricDatum{
+				MetricName: aws.String("UncoveredInstances"),
+				Dimensions: []cwtypes.Dimension{service},
+				Value:      aws.Float64(float64(uncovered)),
+				Unit:       cwtypes.StandardUnitCount,
+				Timestamp:  ts,
+			},
+			cwtypes.MetricDatum{
+				MetricName: aws.String("UnusedReservations"),
+				Dimensions: []cwtypes.Dimension{service},
+				Value:      aws.Float64(float64(unused)),
+				Unit:       cwtypes.StandardUnitCount,
+				Timestamp:  ts,
+			})
+		svc := cloudwatch.NewFromConfig(rep.awsCfg)
+		for len(data) > 0 {
+			n := len(data)
+			if n > maxMetricData {
+				n = maxMetricData
+			}
+			_, err := svc.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+				Namespace:  aws.String(namespace),
+				MetricData: data[:n],
+			})
+			if err != nil {
+				return jobError(rep.Account, rep.Region, err)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// metricDatum returns data point of item v with service dimension, type,
+// tenancy and, when known, platform and AZ dimensions; CloudWatch doesn't
+// allow empty dimension values, so default tenancy is named explicitly
+func metricDatum(name string, service cwtypes.Dimension, v reservations.Item, ts *time.Time) cwtypes.MetricDatum {
+	tenancy := v.Tenancy
+	if tenancy == "" {
+		tenancy = "default"
+	}
+	d := cwtypes.MetricDatum{
+		MetricName: aws.String(name),
+		Dimensions: []cwtypes.Dimension{service, {
+			Name:  aws.String("InstanceType"),
+			Value: aws.String(v.Type),
+		}, {
+			Name:  aws.String("Tenancy"),
+			Value: aws.String(tenancy),
+		}},
+		Value:     aws.Float64(float64(v.Count)),
+		Unit:      cwtypes.StandardUnitCount,
+		Timestamp: ts,
+	}
+	if v.Platform != "" {
+		d.Dimensions = append(d.Dimensions, cwtypes.Dimension{
+			Name:  aws.String("Platform"),
+			Value: aws.String(v.Platform),
+		})
+	}
+	if v.AZ != "" {
+		d.Dimensions = append(d.Dimensions, cwtypes.Dimension{
+			Name:  aws.String("AZ"),
+			Value: aws.String(v.AZ),
+		})
+	}
+	return d
+}
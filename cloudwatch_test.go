@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+func TestMetricDatum(t *testing.T) {
+	service := cwtypes.Dimension{Name: aws.String("Service"), Value: aws.String("ec2")}
+	d := metricDatum("UnusedReservations", service, reservations.Item{
+		Type:     "m5.large",
+		AZ:       "us-east-1a",
+		Platform: "Windows",
+		Count:    2,
+	}, aws.Time(time.Now()))
+	got := make(map[string]string)
+	for _, dim := range d.Dimensions {
+		got[aws.ToString(dim.Name)] = aws.ToString(dim.Value)
+	}
+	want := map[string]string{
+		"Service":      "ec2",
+		"InstanceType": "m5.large",
+		"AZ":           "us-east-1a",
+		"Platform":     "Windows",
+		"Tenancy":      "default",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got dimensions %v, want %v", got, want)
+	}
+	if aws.ToFloat64(d.Value) != 2 {
+		t.Errorf("got value %v, want 2", aws.ToFloat64(d.Value))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// costEstimate is estimated monthly cost of unused reservations and
+// uncovered on-demand instances
+type costEstimate struct {
+	Unused   float64 `json:"unused"`             // hourly charges and amortized upfront price of unused reservations
+	OnDemand float64 `json:"onDemand"`           // uncovered instances at on-demand rates
+	Unpriced int     `json:"unpriced,omitempty"` // rows without known price, not included
+	Currency string  `json:"currency"`
+}
+
+// add adds other to c
+func (c *costEstimate) add(other *costEstimate) {
+	if other == nil {
+		return
+	}
+	c.Unused += other.Unused
+	c.OnDemand += other.OnDemand
+	c.Unpriced += other.Unpriced
+}
+
+// estimateCosts estimates monthly costs of EC2 reports and their total.
+// Total is for aggregated reports in consolidated billing view. On-demand
+// instances must be annotated with annotateRates.
+func estimateCosts(res *result, currency string) {
+	for _, reps := range [][]*report{res.Reports, res.Aggregated} {
+		for _, rep := range reps {
+			if rep.Service == "" || rep.Service == "ec2" {
+				rep.Cost = estimateCost(rep, currency)
+			}
+		}
+	}
+	res.Cost = &costEstimate{Currency: currency}
+	for _, rep := range res.billed() {
+		res.Cost.add(rep.Cost)
+	}
+}
+
+// estimateCost returns estimated monthly cost of report. Instances covered
+// by Savings Plans are not counted. Reservations paid in other currency are
+// not priced.
+func estimateCost(rep *report, currency string) *costEstimate {
+	c := &costEstimate{Currency: currency}
+	for _, v := range rep.UnusedReservations {
+		o := v.Offering
+		if o == nil || !sameCurrency(o.Currency, currency) {
+			c.Unpriced++
+			continue
+		}
+		hourly := o.Hourly
+		if o.Duration > 0 {
+			hourly += o.FixedPrice / (time.Duration(o.Duration) * time.Second).Hours()
+		}
+		c.Unused += hourly * hoursPerMonth * float64(v.Count)
+	}
+	for _, v := range rep.OnDemandInstances {
+		if v.OnDemandRate == 0 {
+			c.Unpriced++
+			continue
+		}
+		if n := v.Count - v.SavingsPlans; n > 0 {
+			c.OnDemand += v.OnDemandRate * hoursPerMonth * float64(n)
+		}
+	}
+	return c
+}
+
+// writeCost writes estimated monthly cost
+func writeCost(w io.Writer, title string, c *costEstimate) {
+	if c == nil {
+		return
+	}
+	fmt.Fprintf(w, "%s:\t%s unused reservations\t%s on-demand instances", title,
+		money(roundCents(c.Unused), c.Currency), money(roundCents(c.OnDemand), c.Currency))
+	if c.Unpriced > 0 {
+		fmt.Fprintf(w, "\t%d rows without price not included", c.Unpriced)
+	}
+	fmt.Fprintln(w)
+}
+
+// costCurrency returns currency of cost estimate, or USD if there's none
+func costCurrency(c *costEstimate) string {
+	if c == nil {
+		return "USD"
+	}
+	return c.Currency
+}
+
+func roundCents(v float64) float64 { return float64(int64(v*100+0.5)) / 100 }
+
+// sameCurrency reports whether currency codes are the same, treating empty
+// one as USD, the default of reservations
+func sameCurrency(a, b string) bool {
+	if a == "" {
+		a = "USD"
+	}
+	if b == "" {
+		b = "USD"
+	}
+	return a == b
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/costexplorer"
+	cetypes "github.com/aws/aws-sdk-go-v2/service/costexplorer/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// ceRegion is the region Cost Explorer API is served from
+const ceRegion = "us-east-1"
+
+// ceService is the Cost Explorer name of EC2 reservations service
+const ceService = "Amazon Elastic Compute Cloud - Compute"
+
+func newCostExplorer(awsCfg aws.Config) *costexplorer.Client {
+	return costexplorer.NewFromConfig(awsCfg, func(o *costexplorer.Options) { o.Region = ceRegion })
+}
+
+// lookbackPeriod returns Cost Explorer lookback period of given number of
+// days, only 7, 30 and 60 days are supported
+func lookbackPeriod(days int) (cetypes.LookbackPeriodInDays, error) {
+	switch days {
+	case 7:
+		return cetypes.LookbackPeriodInDaysSevenDays, nil
+	case 30:
+		return cetypes.LookbackPeriodInDaysThirtyDays, nil
+	case 60:
+		return cetypes.LookbackPeriodInDaysSixtyDays, nil
+	}
+	return "", fmt.Errorf("Cost Explorer recommendations only support 7, 30 or 60 days of usage, not %d", days)
+}
+
+// ceTenancy converts Cost Explorer tenancy to the form used in reports
+func ceTenancy(s string) string {
+	if strings.EqualFold(s, "shared") {
+		return ""
+	}
+	return strings.ToLower(s)
+}
+
+// fetchCERecommendations returns Cost Explorer recommendations of 1 year no
+// upfront standard reservations, based on usage of the last days. With payer
+// set recommendations are made for the whole organization, otherwise per
+// account.
+func fetchCERecommendations(ctx context.Context, awsCfg aws.Config, days int, payer bool) ([]purchase, error) {
+	period, err := lookbackPeriod(days)
+	if err != nil {
+		return nil, err
+	}
+	input := &costexplorer.GetReservationPurchaseRecommendationInput{
+		Service:              aws.String(ceService),
+		AccountScope:         cetypes.AccountScopeLinked,
+		LookbackPeriodInDays: period,
+		PaymentOption:        cetypes.PaymentOptionNoUpfront,
+		TermInYears:          cetypes.TermInYearsOneYear,
+		ServiceSpecification: &cetypes.ServiceSpecification{
+			EC2Specification: &cetypes.EC2Specification{OfferingClass: cetypes.OfferingClassStandard},
+		},
+	}
+	if payer {
+		input.AccountScope = cetypes.AccountScopePayer
+	}
+	svc := newCostExplorer(awsCfg)
+	var out []purchase
+	for {
+		page, err := svc.GetReservationPurchaseRecommendation(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range page.Recommendations {
+			for _, d := range rec.RecommendationDetails {
+				if d.InstanceDetails == nil || d.InstanceDetails.EC2InstanceDetails == nil {
+					continue
+				}
+				ec2d := d.InstanceDetails.EC2InstanceDetails
+				p := purchase{
+					Region:   aws.ToString(ec2d.Region),
+					Type:     aws.ToString(ec2d.InstanceType),
+					Platform: aws.ToString(ec2d.Platform),
+					Tenancy:  ceTenancy(aws.ToString(ec2d.Tenancy)),
+					Scope:    "Region",
+					Flexible: ec2d.SizeFlexEligible,
+				}
+				if !payer {
+					p.Account = aws.ToString(d.AccountId)
+				}
+				fmt.Sscan(aws.ToString(d.RecommendedNumberOfInstancesToPurchase), &p.Count)
+				if s := aws.ToString(d.EstimatedMonthlySavingsAmount); s != "" {
+					p.Savings = s + " " + aws.ToString(d.CurrencyCode)
+				}
+				out = append(out, p)
+			}
+		}
+		if aws.ToString(page.NextPageToken) == "" {
+			return out, nil
+		}
+		input.NextPageToken = page.NextPageToken
+	}
+}
+
+// chronicUtilization is the utilization percentage below which unused
+// reservations are considered chronically unused rather than unused right now
+const chronicUtilization = 50
+
+// utilizationNote returns tab-prefixed human-readable utilization of unused
+// reservations, or empty string if it's not known
+func utilizationNote(v reservations.Item) string {
+	if v.Utilization == nil {
+		return ""
+	}
+	if *v.Utilization < chronicUtilization {
+		return fmt.Sprintf("\tchronically unused, %g%% utilization", *v.Utilization)
+	}
+	return fmt.Sprintf("\tunused right now, %g%% utilization", *v.Utilization)
+}
+
+// ceTimePeriod returns Cost Explorer time period of the last days, up to
+// today, which is excluded
+func ceTimePeriod(days int) *cetypes.DateInterval {
+	end := time.Now().UTC()
+	return &cetypes.DateInterval{
+		Start: aws.String(end.AddDate(0, 0, -days).Format("2006-01-02")),
+		End:   aws.String(end.Format("2006-01-02")),
+	}
+}
+
+// utilizationKey identifies reservations utilization is summed for
+type utilizationKey struct {
+	account string
+	region  string
+	key     reservations.Key
+}
+
+// fetchUtilization returns reserved and used hours of reservations over the
+// last days, summed per account, region, type, AZ (for AZ-scoped
+// reservations), platform and tenancy
+func fetchUtilization(ctx context.Context, awsCfg aws.Config, days int) (map[utilizationKey][2]float64, error) {
+	input := &costexplorer.GetReservationUtilizationInput{
+		TimePeriod: ceTimePeriod(days),
+		GroupBy: []cetypes.GroupDefinition{{
+			Type: cetypes.GroupDefinitionTypeDimension,
+			Key:  aws.String("SUBSCRIPTION_ID"),
+		}},
+		Filter: &cetypes.Expression{Dimensions: &cetypes.DimensionValues{
+			Key:    cetypes.DimensionService,
+			Values: []string{ceService},
+		}},
+	}
+	svc := newCostExplorer(awsCfg)
+	out := make(map[utilizationKey][2]float64)
+	for {
+		page, err := svc.GetReservationUtilization(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page.UtilizationsByTime {
+			for _, g := range t.Groups {
+				if g.Utilization == nil {
+					continue
+				}
+				a := g.Attributes
+				k := utilizationKey{account: a["accountId"], region: a["region"], key: reservations.Key{
+					Type:     a["instanceType"],
+					Platform: a["platform"],
+					Tenancy:  ceTenancy(a["tenancy"]),
+				}}
+				if a["scope"] == "Availability Zone" {
+					k.key.AZ = a["availabilityZone"]
+				}
+				var purchased, used float64
+				fmt.Sscan(aws.ToString(g.Utilization.PurchasedHours), &purchased)
+				fmt.Sscan(aws.ToString(g.Utilization.TotalActualHours), &used)
+				v := out[k]
+				out[k] = [2]float64{v[0] + purchased, v[1] + used}
+			}
+		}
+		if aws.ToString(page.NextPageToken) == "" {
+			return out, nil
+		}
+		input.NextPageToken = page.NextPageToken
+	}
+}
+
+// annotateUtilization sets utilization percentage over the last days of
+// unused reservations in reports, where Cost Explorer has data on them
+func annotateUtilization(ctx context.Context, awsCfg aws.Config, days int, reps []*report) error {
+	hours, err := fetchUtilization(ctx, awsCfg, days)
+	if err != nil {
+		return err
+	}
+	for _, rep := range reps {
+		for i := range rep.UnusedReservations {
+			v := &rep.UnusedReservations[i]
+			var purchased, used float64
+			for k, h := range hours {
+				if k.region != rep.Region || (rep.Account != "" && k.account != rep.Account) ||
+					k.key.Type != v.Type || k.key.AZ != v.AZ || k.key.Tenancy != v.Tenancy ||
+					(v.Platform != "" && k.key.Platform != v.Platform) {
+					continue
+				}
+				purchased += h[0]
+				used += h[1]
+			}
+			if purchased > 0 {
+				p := math.Round(used/purchased*1000) / 10
+				v.Utilization = &p
+			}
+		}
+	}
+	return nil
+}
+
+// coverageMismatch is the difference in percentage points between
+// point-in-time and billing coverage considered a disagreement
+const coverageMismatch = 20
+
+// typeCoverage compares point-in-time coverage of instance type with the one
+// Cost Explorer reports over a period
+type typeCoverage struct {
+	Type            string  `json:"type"`
+	Running         int     `json:"running"`
+	Coverage        float64 `json:"coverage"`        // point-in-time, percent of running instances
+	BillingCoverage float64 `json:"billingCoverage"` // percent of running hours, from Cost Explorer
+	Mismatch        bool    `json:"mismatch,omitempty"`
+}
+
+// fetchCoverage returns reservation coverage percentage of running hours over
+// the last days per region and instance type
+func fetchCoverage(ctx context.Context, awsCfg aws.Config, days int) (map[[2]string]float64, error) {
+	input := &costexplorer.GetReservationCoverageInput{
+		TimePeriod: ceTimePeriod(days),
+		GroupBy: []cetypes.GroupDefinition{
+			{Type: cetypes.GroupDefinitionTypeDimension, Key: aws.String("REGION")},
+			{Type: cetypes.GroupDefinitionTypeDimension, Key: aws.String("INSTANCE_TYPE")},
+		},
+		Filter: &cetypes.Expression{Dimensions: &cetypes.DimensionValues{
+			Key:    cetypes.DimensionService,
+			Values: []string{ceService},
+		}},
+	}
+	svc := newCostExplorer(awsCfg)
+	hours := make(map[[2]string][2]float64) // total and reserved hours
+	for {
+		page, err := svc.GetReservationCoverage(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range page.CoveragesByTime {
+			for _, g := range t.Groups {
+				if g.Coverage == nil || g.Coverage.CoverageHours == nil {
+					continue
+				}
+				k := [2]string{g.Attributes["region"], g.Attributes["instanceType"]}
+				var total, reserved float64
+				fmt.Sscan(aws.ToString(g.Coverage.CoverageHours.TotalRunningHours), &total)
+				fmt.Sscan(aws.ToString(g.Coverage.CoverageHours.ReservedHours), &reserved)
+				v := hours[k]
+				hours[k] = [2]float64{v[0] + total, v[1] + reserved}
+			}
+		}
+		if aws.ToString(page.NextPageToken) == "" {
+			break
+		}
+		input.NextPageToken = page.NextPageToken
+	}
+	out := make(map[[2]string]float64, len(hours))
+	for k, v := range hours {
+		if v[0] > 0 {
+			out[k] = math.Round(v[1]/v[0]*1000) / 10
+		}
+	}
+	return out, nil
+}
+
+// compareCoverage sets coverage per instance type of reports, comparing
+// point-in-time coverage with the one Cost Explorer reports over the last
+// days. Running instances are counted over all reports in res of the same
+// region, so that aggregated reports of multiple accounts can be compared
+// too, as billing coverage is not split by account.
+func compareCoverage(ctx context.Context, awsCfg aws.Config, days int, res *result, reps []*report) error {
+	billing, err := fetchCoverage(ctx, awsCfg, days)
+	if err != nil {
+		return err
+	}
+	for _, rep := range reps {
+		running := make(map[string]int)
+		for _, r := range res.Reports {
+			if r.Region != rep.Region || r.inv == nil {
+				continue
+			}
+			for k, n := range r.inv.Running {
+				running[k.Type] += n
+			}
+		}
+		uncovered := make(map[string]int)
+		for _, v := range rep.OnDemandInstances {
+			uncovered[v.Type] += v.Count
+		}
+		types := make([]string, 0, len(running))
+		for typ := range running {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+		rep.Coverage = nil
+		for _, typ := range types {
+			bc, ok := billing[[2]string{rep.Region, typ}]
+			if !ok {
+				continue
+			}
+			c := typeCoverage{
+				Type:            typ,
+				Running:         running[typ],
+				Coverage:        percent(running[typ]-uncovered[typ], running[typ], 1),
+				BillingCoverage: bc,
+			}
+			c.Mismatch = math.Abs(c.Coverage-c.BillingCoverage) > coverageMismatch
+			rep.Coverage = append(rep.Coverage, c)
+		}
+	}
+	return nil
+}
+
+func writeCoverage(w io.Writer, cs []typeCoverage) {
+	if len(cs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Coverage by instance type (point-in-time vs Cost Explorer):")
+	for _, c := range cs {
+		var note string
+		if c.Mismatch {
+			note = "\tdisagree, check platform and tenancy"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%g%%\t%g%%%s\n", c.Type, c.Running, c.Coverage, c.BillingCoverage, note)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// DynamoDB reserved capacity can't be listed with API, so it's given with
+// -dynamodb-reserved flag. Provisioned read and write capacity units of
+// tables and their global secondary indexes are summed per region and
+// compared with it, reported with "read" and "write" as Key.Type and capacity
+// units as counts. Tables in on-demand capacity mode are not counted.
+
+// reservedCapacity is DynamoDB capacity reserved in a region
+type reservedCapacity struct {
+	Account string // empty for the account of base config
+	Region  string
+	Read    int // read capacity units
+	Write   int // write capacity units
+}
+
+// capacityList is -dynamodb-reserved flag value
+type capacityList []reservedCapacity
+
+func (l *capacityList) String() string {
+	var parts []string
+	for _, c := range *l {
+		loc := c.Region
+		if c.Account != "" {
+			loc = c.Account + "/" + c.Region
+		}
+		parts = append(parts, fmt.Sprintf("%s:read=%d,write=%d", loc, c.Read, c.Write))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Set parses capacity in "[ACCOUNT/]REGION:read=N,write=N" form, either read
+// or write may be omitted
+func (l *capacityList) Set(s string) error {
+	loc, units, ok := strings.Cut(s, ":")
+	if !ok || loc == "" {
+		return fmt.Errorf("invalid reserved capacity %q, must be in [account/]region:read=N,write=N form", s)
+	}
+	var c reservedCapacity
+	if c.Account, c.Region, ok = strings.Cut(loc, "/"); !ok {
+		c.Account, c.Region = "", loc
+	}
+	for _, kv := range strings.Split(units, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid capacity units in %q", s)
+		}
+		switch k {
+		case "read":
+			c.Read += n
+		case "write":
+			c.Write += n
+		default:
+			return fmt.Errorf("invalid reserved capacity %q, only read and write units can be set", s)
+		}
+	}
+	*l = append(*l, c)
+	return nil
+}
+
+// fetchDynamoDB sums provisioned capacity of tables and takes reserved
+// capacity of account and region from cfg
+func fetchDynamoDB(ctx context.Context, account string, awsCfg aws.Config, cfg config, prog *progress) (*reservations.Inventory, *reservations.Reservations, error) {
+	svc := dynamodb.NewFromConfig(awsCfg)
+	inv := reservations.NewInventory()
+	prog.Printf("fetching DynamoDB tables in %s", awsCfg.Region)
+	add := func(t *types.ProvisionedThroughputDescription) {
+		if t != nil {
+			inv.Running[reservations.Key{Type: "read"}] += int(aws.ToInt64(t.ReadCapacityUnits))
+			inv.Running[reservations.Key{Type: "write"}] += int(aws.ToInt64(t.WriteCapacityUnits))
+		}
+	}
+	p := dynamodb.NewListTablesPaginator(svc, &dynamodb.ListTablesInput{})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, name := range page.TableNames {
+			out, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)})
+			if err != nil {
+				return nil, nil, err
+			}
+			t := out.Table
+			if t == nil || t.BillingModeSummary != nil && t.BillingModeSummary.BillingMode == types.BillingModePayPerRequest {
+				continue
+			}
+			add(t.ProvisionedThroughput)
+			for _, idx := range t.GlobalSecondaryIndexes {
+				add(idx.ProvisionedThroughput)
+			}
+		}
+	}
+	for k, v := range inv.Running {
+		if v == 0 {
+			delete(inv.Running, k)
+		}
+	}
+	ris := reservations.NewReservations()
+	for _, c := range cfg.DynamoDBReserved {
+		if c.Account != account || c.Region != awsCfg.Region {
+			continue
+		}
+		if c.Read > 0 {
+			ris.Region[reservations.Key{Type: "read"}] += c.Read
+		}
+		if c.Write > 0 {
+			ris.Region[reservations.Key{Type: "write"}] += c.Write
+		}
+	}
+	return inv, ris, nil
+}
@@ -1,172 +1,1672 @@
 // Command ec2-reservations reports mismatch of running on-demand ec2 instances
-// and number of reserved instances. It does not take into account additional
-// instance attributes like Linux/non-linux, VPC/non-VPC, it only matches
-// instances/reservations based on type (like m3.medium) and availability zone
-// (in case of AZ-scoped reservations).
+// and number of reserved instances. It matches instances/reservations based on
+// type (like m3.medium), platform (Linux/UNIX, Windows, Red Hat Enterprise
+// Linux, etc.), tenancy (default, dedicated, host) and availability zone (in
+// case of AZ-scoped reservations). Use -ignore-platform flag to match
+// regardless of platform. Instances running on dedicated hosts are billed per
+// host, so reserved instances never cover them. Spot instances are not
+// counted, use -include-spot flag to treat them as on-demand ones, or -spot
+// flag to list them in a separate report section. Only running instances are
+// counted, use -include-stopped flag to also count stopped ones, so that fleets
+// stopped for the night don't make reservations look unused. Only active
+// reservations are counted; right after a purchase reservations are pending
+// payment for a while, use -include-payment-pending flag to count them too.
+// Reservations listed for sale on Reserved Instance Marketplace are counted
+// until sold; -listings flag lists them in a separate report section, and
+// -exclude-listed flag also stops counting their unsold instances.
+//
+// Region-scoped Linux/UNIX reservations with default tenancy are matched the
+// way AWS bills them: within instance family regardless of size, using
+// normalization factors. Unused part of such reservations is reported in
+// concrete sizes. Use -strict-types flag to only match reservations with
+// instances of exactly the same type.
+//
+// Report starts with a summary line, such as "243 running, 220 covered
+// (90.5%), 23 on-demand, 12 unused RIs", totaling all accounts and regions
+// (aggregated reports with -float). It's also included in json, markdown and
+// html formats. Text and json reports also show coverage percentage per
+// instance family, lowest first, since size-flexible reservations make family
+// the granularity purchases are planned at. Use -group-by family flag to
+// collapse sizes of on-demand instances, unused reservations and spot
+// instances into families, which keeps report readable when a dozen sizes of
+// the same family run; add -normalized flag to count them in normalized units:
+// AWS normalization factor times 4, so that nano size is 1 unit and counts
+// stay whole (i.e. 2 large instances and 1 xlarge are 64 units). Grouping
+// only changes how rows are written: -max-uncovered and -max-unused still
+// count instances.
+//
+// Use -group-by tag:key flag to split on-demand EC2 instances by value of
+// given tag, i.e. -group-by tag:Team, to charge back on-demand overage to
+// teams. Reservations apply to instances regardless of their tags, so
+// on-demand instances of each type, zone, platform and tenancy are attributed
+// to tag values in proportion to the number of running instances having them.
+// Instances without the tag are shown as untagged. With -costs flag, monthly
+// on-demand cost of each tag value is shown too. Only text and json reports
+// show this split.
+//
+// Use -asgs flag to break down on-demand EC2 instances by Auto Scaling group
+// the same way, using aws:autoscaling:groupName tag Auto Scaling sets on
+// instances. Groups running a single instance type are also checked against
+// reservations: if desired capacity of the group is above reservations of
+// its type, platform and tenancy, less ones used by instances of the type
+// outside the group, report warns that scaling to desired capacity runs
+// on-demand. Desired capacity is fetched with DescribeAutoScalingGroups, so
+// this check is not done with -replay and -instances-file.
+//
+// Use -eks flag to report coverage per Kubernetes cluster and node group,
+// since cluster autoscaling often is where on-demand instances come from.
+// Nodes are recognized by tags EKS managed node groups (eks:cluster-name,
+// eks:nodegroup-name), Karpenter (karpenter.sh/nodepool, reported as
+// karpenter:pool group) and eksctl set, or by kubernetes.io/cluster/name tag
+// of self-managed nodes. On-demand instances are attributed to node groups
+// the same way as with -group-by tag:key, groups with lowest coverage first.
+//
+// Program exits with code 0 if all instances are covered and there are no
+// unused reservations, with code 2 if there's a mismatch, and with code 1 on
+// error. Use -max-uncovered and -max-unused flags to tolerate small mismatch:
+// it's still reported, but doesn't trigger exit code 2, events and webhooks.
 //
 // Use regular AWS SDK variables to set authentication and region:
-// AWS_SECRET_KEY, AWS_ACCESS_KEY, AWS_REGION.
+// AWS_SECRET_KEY, AWS_ACCESS_KEY, AWS_REGION, AWS_PROFILE. Shared config
+// profiles are supported, including IAM Identity Center (SSO) ones and ones
+// using credential_process; use -profile flag to select profile without
+// setting environment, i.e. -profile prod-readonly. Likewise, -region flag
+// takes precedence over AWS_REGION and shared config.
+//
+// Use -assume-role flag to run with credentials of a role in another account,
+// i.e. when auditing customer accounts; -external-id and -mfa-serial flags
+// pass external id and MFA device the role trust policy may require. With
+// -mfa-serial token code is prompted for on stderr and read from stdin. Roles
+// assumed in accounts given by -accounts or -org are assumed on top of it.
+//
+// Use -regions flag to report on multiple regions at once, or -all-regions to
+// discover and report on all regions enabled for the account; reservations are
+// region-bound, so each region is reconciled and reported separately. Regions
+// and accounts are inspected concurrently, at most -concurrency of them at a
+// time, so that large organizations don't run into API rate limits.
+//
+// Use -watch flag to keep the tool running and reporting repeatedly, i.e. on
+// ops screen during reservations purchase; with -watch-changes it only reports
+// when results change.
+//
+// Use -timeout flag to limit time a single report may take, i.e. -timeout 60s,
+// so that hung API call doesn't stall a cron job. With -watch and serve the
+// limit applies to each refresh. Interrupt aborts API calls in flight.
+//
+// Failed and throttled API calls are retried with exponential backoff, use
+// -max-retries and -retry-max-delay flags to tune it when scanning many
+// accounts and regions hits RequestLimitExceeded errors; -retry-mode adaptive
+// also slows down API calls client-side once they get throttled. Throttled
+// calls are shown with -progress flag, and counted with -stats flag; without
+// -stats their total is reported on stderr as a warning.
+//
+// Use -endpoint-url flag or AWS_ENDPOINT_URL environment variable to point the
+// tool at LocalStack or moto, i.e. -endpoint-url http://localhost:4566.
+//
+// Use -accounts or -accounts-file to report on multiple accounts: the tool
+// assumes role in each account (either given by ARN, or role named by
+// -role-name for accounts given by id), reports on each account separately,
+// and then reports aggregated numbers for all accounts. When run with
+// credentials of organization management (or delegated administrator)
+// account, -org flag discovers all active member accounts automatically.
+// With consolidated billing Region-scoped reservations purchased in one
+// account also cover instances of other accounts; use -float flag to get
+// aggregated report reflecting this.
+//
+// HTTPS_PROXY and NO_PROXY environment variables are honored for AWS API
+// requests; -proxy flag takes precedence over them and sends all requests
+// through given proxy.
+//
+// Run it as "ec2-reservations serve" to start HTTP server exposing
+// reconciliation results as Prometheus metrics at /metrics, and as report at
+// /report (use format query parameter to select format, i.e.
+// /report?format=html). Data is refreshed every -interval.
+//
+// Use -instance-ids flag to only inspect specific instances, i.e. to check
+// whether particular instance is covered by reservation. Note that unused
+// reservations are still reported based on all account reservations, so with
+// this flag this section is expected to be noisy. The same applies to -tag
+// flag that limits report to instances having given tags, i.e. owned by a
+// single team: -tag team=search. If -tag is repeated with the same key,
+// instance must have any of given values; with different keys it must have
+// all of them.
+//
+// Use -exclude-tag flag to skip intentionally ephemeral instances like CI
+// runners: -exclude-tag role=ci -exclude-tag role=batch.
+//
+// Use -types and -exclude-types flags to limit both instances and reservations
+// to types matching glob patterns, i.e. -types 'm5.*,c5.*' -exclude-types
+// 'm5.metal'. Note that size-flexible reservations of excluded sizes don't
+// cover instances of included sizes of the same family.
+//
+// Use -az flag to limit report to specific availability zones, i.e. -az
+// us-east-1a,us-east-1b. Region-scoped reservations apply to any zone, so they
+// are still matched in full, and may be reported as unused.
+//
+// Use -filter flag to pass arbitrary DescribeInstances filters, i.e. -filter
+// vpc-id=vpc-0123 -filter subnet-id=subnet-1,subnet-2. See
+// https://docs.aws.amazon.com/AWSEC2/latest/APIReference/API_DescribeInstances.html
+// for supported filter names.
+//
+// Instances are counted page by page as they are fetched, so memory use
+// doesn't grow with the fleet size, and JSON report is encoded and written one
+// account and region at a time. For very large fleets use -page-size flag to
+// lower peak memory use, i.e. when running as AWS Lambda function: build it
+// with "lambda" tag and pass flags in EC2_RESERVATIONS_ARGS environment
+// variable.
+//
+// Use simulate command to see how report would look like after hypothetical
+// changes applied on top of fetched data, i.e. to sanity-check reservation
+// purchase before committing to it:
+//
+//	ec2-reservations simulate "add 10 m5.xlarge in us-east-1a" "remove 4 c5.large RIs"
+//
+// Each change is a separate argument in the form "add|remove N TYPE [in
+// LOCATION] [RIs]". Changes ending with RIs apply to reservations: ones with
+// AZ as LOCATION are AZ-scoped, ones with region or without LOCATION are
+// Region-scoped. Other changes apply to instances and require AZ. Simulated
+// instances and reservations are Linux/UNIX ones with default tenancy.
+// Simulated report is written to stdout, no events, notifications or metrics
+// are sent.
+//
+// Use recommend command to get list of Region-scoped reservations to purchase
+// to cover on-demand instances, optionally only up to coverage percentage set
+// with -coverage-target flag; instance types with most on-demand instances
+// are covered first. Linux/UNIX instances with default tenancy of the same
+// family are grouped into size-flexible reservations of the smallest size
+// seen, unless -strict-types is set. With -float purchases are planned for
+// all accounts at once, otherwise per account. Use -format json to get the
+// list in machine-readable form. Add -cost-explorer flag to also show
+// purchases Cost Explorer recommends based on usage history of the last
+// -lookback-days days (7, 30 or 60), to see where point-in-time view
+// disagrees with usage-based advice. Cost Explorer recommendations are for 1
+// year standard reservations without upfront payment, and cover all regions.
+// Cost Explorer API must be enabled, and it's charged per request. Add -costs
+// flag to get months to break even for each purchase: upfront price of
+// standard 1 year Region-scoped offering with payment option set by
+// -payment-option is divided by monthly difference between its hourly rate
+// and on-demand rate. Purchases paying off sooner are listed first.
+//
+// Add -cost-explorer flag to regular report to annotate unused reservations
+// with their utilization over the last -lookback-days days taken from Cost
+// Explorer, to tell reservations unused right now from chronically unused
+// ones (below 50% utilization). Utilization is shown in text and JSON
+// reports. Cost Explorer coverage over the same period is also shown per
+// instance type next to point-in-time coverage; types where they differ by
+// more than 20 percentage points are flagged, which usually is a sign of
+// platform or tenancy mismatch. With multiple accounts coverage is compared
+// for all accounts, since Cost Explorer doesn't split it per account. It's
+// not available with -replay and -instances-file.
+//
+// On-demand instances may be covered by Compute or EC2 Instance Savings Plans,
+// which apply to spend rather than to particular instances. Use
+// -savings-plans flag to take them into account: Savings Plans coverage of
+// spend not covered by reservations is fetched from Cost Explorer for the
+// last -lookback-days days per region and instance family, and the same
+// share of on-demand instances of the family is estimated to be covered.
+// Such instances are annotated in text and JSON reports, they don't count
+// towards -max-uncovered, and recommend command doesn't plan reservations
+// for them. Coverage is not split per account. With -savings-plans, report
+// also lists active Compute and EC2 Instance Savings Plans of inspected
+// accounts, and their total commitment and utilization over the same period.
+// With recommend command, -savings-plans flag also shows Cost Explorer
+// recommendation of 1 year no upfront Compute Savings Plan for the same usage
+// history, and whether it saves more than reservations Cost Explorer
+// recommends. Compute Savings Plan applies to any instance family, size,
+// region, platform and tenancy, so it suits usage that changes over time.
+//
+// On-Demand Capacity Reservations are billed whether instances use them or
+// not. Use -capacity-reservations flag to also list active capacity
+// reservations with unused capacity, summed per instance type, AZ, platform
+// and tenancy, along with the number of matching running instances. If there
+// are more matching instances than reservations are used by, reservations are
+// probably targeted, or instances were launched to not use open reservations.
+// Capacity Reservation Fleets are listed with their target capacity, capacity
+// fulfilled by reservations and capacity used by instances, all in units of
+// fleet instance type weights; fleets using less capacity than fulfilled are
+// flagged as over-provisioned. Active Capacity Blocks for ML are listed
+// separately with the number of instances running in them; blocks with no
+// instances running are flagged as idle, since they're paid upfront for the
+// whole block duration.
+//
+// Unused EC2 reservations are shown with the earliest end date of matching
+// reservations and remaining term, to tell reservations about to expire anyway
+// from ones that will be wasted for long, and with payment terms of the same
+// reservations: offering type, upfront price and hourly charge per instance.
+// Reservations ending soon are listed with -expiring-within flag:
+// -expiring-within 30d lists active reservations ending within 30 days,
+// whether they're used or not, with their end dates; period may also be given
+// as Go duration, i.e. 72h. Reservations queued for purchase at a future date
+// are not counted, they're listed separately as incoming, with their start
+// dates, so that purchases already made to replace expiring reservations are
+// visible.
+//
+// If there are convertible reservations, report also shows number of standard
+// and convertible reservations per instance type, as unused convertible
+// reservations can be exchanged, while standard ones can only be modified or
+// sold.
+//
+// With -recommend flag, report suggests exchanging unused convertible
+// reservations for ones covering on-demand instances of other families. Add
+// -exchange-quotes flag to turn suggestions into concrete proposals: whole
+// convertible reservations to exchange are picked (ending soonest first),
+// target is a no upfront convertible offering for the most common on-demand
+// type of the family with the same normalized size, and the exchange is
+// quoted with GetReservedInstancesExchangeQuote, reporting whether it's valid
+// and payment due. Quotes don't purchase anything. Unused AZ-scoped
+// reservations of types running uncovered in other zones of the region are
+// suggested to be moved there with ModifyReservedInstances. Unused AZ-scoped
+// reservations left are suggested to be changed to Region scope if instances
+// they could cover run uncovered in other zones, since Region-scoped
+// reservations apply to instances in any zone, and Linux/UNIX ones are also
+// size flexible. -modify-commands flag adds aws CLI command doing the
+// modification to each suggestion.
+//
+// Use -costs flag to estimate monthly cost of waste: unused reservations are
+// priced at their hourly charges plus upfront price spread over the term, and
+// on-demand instances not covered by reservations or Savings Plans at
+// on-demand rates from Price List API, shown for each row of on-demand
+// instances. Estimates are in USD, or in CNY with -currency CNY for China
+// regions: these are the only currencies Price List API publishes on-demand
+// rates in, CNY ones only at China partition endpoint, so each currency only
+// works with credentials and regions of its partition. Only reservations paid
+// in the same currency are priced. Rows without known price are counted but
+// not included. Rates are cached for a week in a file set with -price-cache,
+// which is in user cache directory by default.
+//
+// Dedicated Host Reservations apply to particular hosts. Use -dedicated-hosts
+// flag to also list allocated Dedicated Hosts without reservation, with the
+// number of instances running on them and share of host vCPUs they use, and
+// active reservations some reserved hosts of which are released.
+//
+// Reservations of other services are reconciled with -service flag:
+// -service rds compares RDS DB instances with reserved DB instances by
+// instance class, engine and deployment. Reservations of MySQL, MariaDB,
+// PostgreSQL, Aurora and BYOL engines are size flexible within class family,
+// as EC2 ones are, and Multi-AZ DB instance of such engine counts as two
+// instances, since Multi-AZ reservation covers twice as much. Multi-AZ DB
+// instances of other engines are reported with "Multi-AZ" suffix of engine.
+// -service elasticache compares ElastiCache nodes with reserved cache nodes by
+// node type and engine, reservations are size flexible within node family.
+// -service redshift compares nodes of provisioned Redshift clusters with
+// reserved nodes of the same type; paused clusters are skipped unless
+// -include-stopped is set. -service opensearch compares data and dedicated
+// master nodes of OpenSearch Service domains with reserved instances of the
+// same instance type; UltraWarm nodes are not counted. -service memorydb
+// compares primary and replica nodes of MemoryDB clusters with reserved nodes,
+// which are size flexible within node family.
+//
+// DynamoDB reserved capacity can't be listed with API, so -service dynamodb
+// compares provisioned read and write capacity units of tables (and their
+// global secondary indexes) summed per region with capacity given with
+// -dynamodb-reserved flag, i.e. -dynamodb-reserved us-east-1:read=1000,write=500.
+// In multi-account mode prefix region with account id the capacity was
+// purchased in: 123456789012/us-east-1:write=200. Capacity units are reported
+// as counts of "read" and "write" types, tables in on-demand capacity mode are
+// not counted.
+//
+// Flags selecting EC2 instances, i.e. -filter or -tag, and EC2-only features
+// like -cost-explorer or recommend command are not supported for other
+// services. Use -service all for a single report on EC2 and all other
+// services, i.e. for monthly commitment review: reports are grouped by
+// service, have service field in JSON and events, and CSV gets service column
+// first. Flags selecting EC2 instances only apply to EC2 then.
+//
+// Use -record flag to save raw EC2 API responses to a directory, and -replay
+// flag to make report from them later, without AWS credentials, i.e. to
+// reproduce reported discrepancy offline: -record /tmp/case-1234, then
+// -replay /tmp/case-1234. Responses are saved per account and region, so
+// replay covers the same accounts and regions as recording did, flags
+// selecting them are ignored; flags affecting matching, like -ignore-platform
+// or -types, are applied on replay as usual. Replayed single account reports
+// have no account id.
+//
+// Use -instances-file and -reservations-file flags to make report from data
+// exported with AWS CLI, without access to AWS API:
+//
+//	aws ec2 describe-instances > inventory.json
+//	aws ec2 describe-reserved-instances > ris.json
+//	ec2-reservations -instances-file inventory.json -reservations-file ris.json
+//
+// Files are expected to cover a single account and region, which is set with
+// -region flag, if needed. Running instances and active reservations are
+// selected from files the same way the API does; -az, -tag and -instance-ids
+// flags are applied too, while -filter flags other than tag:key ones, and
+// -owner-id and -requester-id flags are not supported. Without
+// -reservations-file all instances are reported as on-demand.
+//
+// Fetching and reconciliation logic is available as a library in
+// github.com/artyom/ec2-reservations/reservations package, for programs that
+// need the report as data rather than running this tool.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
-	"text/tabwriter"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/artyom/ec2-reservations/reservations"
 )
 
 func main() {
-	if err := do(os.Stdout); err != nil {
+	var cfg config
+	cfg.register(flag.CommandLine)
+	if lambdaStart != nil {
+		// built with lambda tag: flags are taken from environment
+		flag.CommandLine.Parse(strings.Fields(os.Getenv(lambdaArgsEnv)))
+		lambdaStart(cfg)
+		return
+	}
+	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		err = run(ctx, cfg)
+	case "serve":
+		// allow flags after command name
+		flag.CommandLine.Parse(flag.Args()[1:])
+		err = serve(ctx, cfg)
+	case "recommend":
+		flag.CommandLine.Parse(flag.Args()[1:])
+		err = recommend(ctx, os.Stdout, cfg)
+	case "simulate":
+		// allow flags after command name, changes follow them
+		flag.CommandLine.Parse(flag.Args()[1:])
+		err = simulate(ctx, cfg, flag.Args())
+	default:
+		err = fmt.Errorf("unknown command: %q", cmd)
+	}
+	stop()
+	switch {
+	case errors.Is(err, errMismatch):
+		os.Exit(2)
+	case err != nil:
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func do(w io.Writer) error {
-	sess, err := session.NewSession()
+// errMismatch is returned when report has more on-demand instances or unused
+// reservations than tolerated; program exits with code 2 then
+var errMismatch = errors.New("mismatch found")
+
+// run writes report to the destination set by cfg: either stdout or file,
+// optionally compressed. Output file is compressed if -gzip is set or its name
+// ends with .gz; stdout is only compressed if -gzip is set.
+func run(ctx context.Context, cfg config) error {
+	if cfg.Record != "" && cfg.Replay != "" {
+		return errors.New("-record and -replay are mutually exclusive")
+	}
+	if cfg.ReservationsFile != "" && cfg.InstancesFile == "" {
+		return errors.New("-reservations-file requires -instances-file")
+	}
+	if cfg.InstancesFile != "" && (cfg.Record != "" || cfg.Replay != "") {
+		return errors.New("-instances-file can't be used with -record or -replay")
+	}
+	if cfg.Watch > 0 {
+		if cfg.Output != "" || cfg.Gzip {
+			return fmt.Errorf("-watch only supports writing to stdout")
+		}
+		return watch(ctx, os.Stdout, cfg)
+	}
+	name := cfg.Output
+	if cfg.Gzip && name != "" && !strings.HasSuffix(name, ".gz") {
+		name += ".gz"
+	}
+	if name == "" && !cfg.Gzip {
+		return do(ctx, os.Stdout, cfg)
+	}
+	f := os.Stdout
+	if name != "" {
+		var err error
+		if f, err = os.Create(name); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	var w io.Writer = f
+	var gw *gzip.Writer
+	if cfg.Gzip || strings.HasSuffix(name, ".gz") {
+		gw = gzip.NewWriter(f)
+		w = gw
+	}
+	err := do(ctx, w, cfg)
+	if err != nil && !errors.Is(err, errMismatch) {
+		return err
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return err
+		}
+	}
+	if name != "" {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return err // nil or errMismatch
+}
+
+// userAgent identifies this tool in User-Agent of API requests
+const userAgent = "ec2-reservations"
+
+// -retry-mode values
+const (
+	retryStandard = "standard"
+	retryAdaptive = "adaptive"
+)
+
+// lambdaStart is set when program is built with lambda tag, see lambda.go
+var lambdaStart func(config)
+
+// lambdaArgsEnv is the environment variable holding space-separated flags when
+// running as Lambda function
+const lambdaArgsEnv = "EC2_RESERVATIONS_ARGS"
+
+// register registers flags setting cfg fields on fs
+func (cfg *config) register(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Service, "service", "ec2", "`service` to reconcile reservations of: ec2, rds, elasticache, redshift, opensearch, dynamodb, memorydb, or all of them")
+	fs.Var(&cfg.DynamoDBReserved, "dynamodb-reserved", "DynamoDB reserved capacity in `[account/]region:read=N,write=N` form, for -service dynamodb (can be repeated)")
+	fs.BoolVar(&cfg.IgnorePlatform, "ignore-platform", false, "don't take platform (Linux, Windows, etc.) into account when matching instances with reservations")
+	fs.BoolVar(&cfg.IncludeSpot, "include-spot", false, "count spot instances as on-demand ones")
+	fs.BoolVar(&cfg.IncludeStopped, "include-stopped", false, "count stopped instances as running ones")
+	fs.BoolVar(&cfg.PaymentPending, "include-payment-pending", false, "count reservations in payment-pending state as active ones")
+	fs.BoolVar(&cfg.Listings, "listings", false, "also report reservations listed for sale on Reserved Instance Marketplace")
+	fs.BoolVar(&cfg.ExcludeListed, "exclude-listed", false, "don't count reservations listed for sale on Reserved Instance Marketplace (implies -listings)")
+	fs.BoolVar(&cfg.Spot, "spot", false, "report spot instances in a separate section")
+	fs.BoolVar(&cfg.StrictTypes, "strict-types", false, "match reservations with instances of the exact type only, ignoring size flexibility")
+	fs.Var(&cfg.Types, "types", "comma-separated `list` of instance type glob patterns (like m5.*) to limit report to")
+	fs.Var(&cfg.ExcludeTypes, "exclude-types", "comma-separated `list` of instance type glob patterns (like t2.*) to skip")
+	fs.Var(&cfg.AZs, "az", "comma-separated `list` of availability zones to limit report to")
+	fs.Var(&cfg.Filters, "filter", "extra DescribeInstances filter in `name=value` form, i.e. vpc-id=vpc-123 (can be repeated, value may be a comma-separated list)")
+	fs.Var(&cfg.Tags, "tag", "only inspect instances having tag in `key=value` form (can be repeated, instance must match all keys)")
+	fs.Var(&cfg.ExcludeTags, "exclude-tag", "skip instances having tag in `key=value` form (can be repeated)")
+	fs.Var(&cfg.InstanceIDs, "instance-ids", "comma-separated `list` of instance ids to limit report to")
+	fs.Var(&cfg.OwnerIDs, "owner-id", "comma-separated `list` of account ids owning instance reservations to limit report to")
+	fs.Var(&cfg.RequesterIDs, "requester-id", "comma-separated `list` of requester ids (i.e. services launching instances on your behalf) to limit report to")
+	fs.BoolVar(&cfg.Progress, "progress", false, "report fetch progress to stderr (only if it's a terminal)")
+	fs.BoolVar(&cfg.Stats, "stats", false, "report number of API calls made to stderr")
+	fs.IntVar(&cfg.PageSize, "page-size", 0, "number of instances to request per DescribeInstances page, 5 to 1000 (0 is API default)")
+	fs.IntVar(&cfg.MaxPages, "max-pages", 0, "stop after fetching this many pages of instances, report is incomplete then (0 is no limit)")
+	fs.DurationVar(&cfg.Timeout, "timeout", 0, "time limit for the whole report, including API calls and delivery (0 is no limit)")
+	fs.StringVar(&cfg.Region, "region", "", "AWS `region` to use instead of the one from environment or shared config")
+	fs.StringVar(&cfg.Profile, "profile", "", "shared config `profile` to use instead of AWS_PROFILE")
+	fs.StringVar(&cfg.AssumeRole, "assume-role", "", "`ARN` of the role to assume before making any other API calls")
+	fs.StringVar(&cfg.ExternalID, "external-id", "", "external `id` to pass when assuming -assume-role role")
+	fs.StringVar(&cfg.MFASerial, "mfa-serial", "", "`ARN` of MFA device required by -assume-role role, token code is read from stdin")
+	fs.StringVar(&cfg.EndpointURL, "endpoint-url", os.Getenv("AWS_ENDPOINT_URL"), "custom AWS API endpoint `URL` used for all services, i.e. LocalStack (defaults to AWS_ENDPOINT_URL)")
+	fs.IntVar(&cfg.MaxRetries, "max-retries", -1, "max number of retries of failed or throttled API call (-1 is SDK default)")
+	fs.StringVar(&cfg.RetryMode, "retry-mode", retryStandard, "API call retry `mode`: standard, or adaptive to also rate-limit calls client-side once throttled")
+	fs.DurationVar(&cfg.RetryMaxDelay, "retry-max-delay", 0, "max delay between retries of API call (0 is SDK default)")
+	fs.DurationVar(&cfg.HTTPTimeout, "http-timeout", 0, "timeout for a single HTTP request to AWS API (0 is SDK default)")
+	fs.IntVar(&cfg.HTTPIdleConns, "http-idle-conns", 0, "max idle keep-alive connections per host (0 is SDK default)")
+	fs.BoolVar(&cfg.HTTPNoKeepAlive, "http-no-keepalive", false, "disable HTTP keep-alives, use each connection for a single request")
+	fs.StringVar(&cfg.Proxy, "proxy", "", "proxy `URL` to use for AWS API, overrides HTTPS_PROXY/NO_PROXY environment")
+	fs.StringVar(&cfg.UserAgentSuffix, "user-agent-suffix", "", "`text` to append to User-Agent of API requests, i.e. for CloudTrail auditing")
+	fs.StringVar(&cfg.Record, "record", "", "save raw EC2 API responses to this `directory`, to reproduce report later with -replay")
+	fs.StringVar(&cfg.Replay, "replay", "", "make report from EC2 API responses saved with -record to this `directory`, without calling AWS")
+	fs.StringVar(&cfg.InstancesFile, "instances-file", "", "read instances from `file` with 'aws ec2 describe-instances' output instead of calling AWS")
+	fs.StringVar(&cfg.ReservationsFile, "reservations-file", "", "read reservations from `file` with 'aws ec2 describe-reserved-instances' output, used with -instances-file")
+	fs.StringVar(&cfg.Output, "o", "", "write report to this `file` instead of stdout")
+	fs.BoolVar(&cfg.Gzip, "gzip", false, "gzip-compress report; with -o adds .gz suffix to file name if it's missing")
+	fs.StringVar(&cfg.EventFile, "event-file", "", "if mismatch is found, write JSON event describing it to this `file` (- for stdout)")
+	fs.StringVar(&cfg.Webhook, "webhook", "", "if mismatch is found, POST its summary to this `URL`")
+	fs.StringVar(&cfg.WebhookTemplate, "webhook-template", "json", "text/template `file` to render webhook payload from, or name of built-in one: json, slack, teams")
+	fs.Var(&cfg.WebhookHeaders, "webhook-header", "extra webhook request `header` in \"Name: value\" form (can be repeated)")
+	fs.IntVar(&cfg.WebhookRetries, "webhook-retries", 3, "number of webhook request retries on network errors and 429/5xx responses")
+	fs.StringVar(&cfg.SlackWebhook, "slack-webhook", "", "if mismatch is found, post its summary to this Slack incoming webhook `URL`")
+	fs.StringVar(&cfg.TeamsWebhook, "teams-webhook", "", "if mismatch is found, post its summary to this Microsoft Teams incoming webhook `URL`")
+	fs.StringVar(&cfg.SNSTopic, "sns-topic", "", "if mismatch is found, publish report in -format to SNS topic with this `ARN`")
+	fs.Var(&cfg.EmailTo, "email-to", "comma-separated `list` of addresses to email report in -format to via SES")
+	fs.StringVar(&cfg.EmailFrom, "email-from", "", "email sender `address`, must be verified in SES")
+	fs.StringVar(&cfg.EmailSubject, "email-subject", "EC2 reservations report", "email `subject`")
+	fs.IntVar(&cfg.Precision, "precision", 1, "number of decimal places in percentages")
+	fs.BoolVar(&cfg.Modifications, "modifications", false, "also report reservations with modifications in progress")
+	fs.BoolVar(&cfg.CapacityReservations, "capacity-reservations", false, "also report unused capacity of On-Demand Capacity Reservations")
+	fs.Var(&cfg.ExpiringWithin, "expiring-within", "also report reservations ending within this `period`, i.e. 30d")
+	fs.BoolVar(&cfg.DedicatedHosts, "dedicated-hosts", false, "also report Dedicated Hosts without reservation and Dedicated Host Reservations without hosts")
+	fs.Float64Var(&cfg.CoverageTarget, "coverage-target", 100, "`percentage` of running instances recommend command plans to cover with reservations")
+	fs.StringVar(&cfg.PaymentOption, "payment-option", "partial-upfront", "payment `option` of offerings recommend command computes break-even for with -costs: all-upfront, partial-upfront or no-upfront")
+	fs.BoolVar(&cfg.CostExplorer, "cost-explorer", false, "cross-check report with Cost Explorer data based on usage history; with recommend command, show Cost Explorer purchase recommendations")
+	fs.BoolVar(&cfg.SavingsPlans, "savings-plans", false, "estimate on-demand instances covered by Savings Plans from Cost Explorer, and don't count them as uncovered; also report Savings Plans utilization; with recommend command, compare Compute Savings Plan with reservations")
+	fs.IntVar(&cfg.LookbackDays, "lookback-days", 30, "`days` of usage history Cost Explorer data is based on: 7, 30 or 60")
+	fs.BoolVar(&cfg.Recommend, "recommend", false, "suggest exchanges of unused convertible reservations to cover on-demand instances")
+	fs.BoolVar(&cfg.ExchangeQuotes, "exchange-quotes", false, "get exchange quotes for exchanges suggested with -recommend")
+	fs.BoolVar(&cfg.ModifyCommands, "modify-commands", false, "print aws CLI commands for reservation modifications suggested with -recommend")
+	fs.BoolVar(&cfg.ASGs, "asgs", false, "break down on-demand instances by Auto Scaling group, and warn about groups with desired capacity above reservations for their type")
+	fs.BoolVar(&cfg.EKS, "eks", false, "report coverage per Kubernetes cluster and node group of EKS and Karpenter nodes")
+	fs.BoolVar(&cfg.Costs, "costs", false, "estimate monthly cost of unused reservations and uncovered on-demand instances, using Price List API")
+	fs.StringVar(&cfg.Currency, "currency", "USD", "`code` of currency to estimate costs in with -costs: USD, or CNY for China regions")
+	fs.StringVar(&cfg.PriceCache, "price-cache", defaultPriceCache(), "`file` to cache on-demand rates from Price List API in for a week, empty to disable caching")
+	fs.Var(&cfg.Regions, "regions", "comma-separated `list` of regions to report on, each separately (default is the region from environment)")
+	fs.BoolVar(&cfg.AllRegions, "all-regions", false, "report on all regions enabled for the account, overrides -regions")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 8, "max number of regions and accounts inspected at once (0 is no limit)")
+	fs.Var(&cfg.Accounts, "accounts", "comma-separated `list` of account ids or role ARNs to assume role in and report on")
+	fs.StringVar(&cfg.AccountsFile, "accounts-file", "", "`file` with account ids or role ARNs to report on, one per line")
+	fs.StringVar(&cfg.RoleName, "role-name", defaultRoleName, "`name` of the role to assume in accounts given by id")
+	fs.BoolVar(&cfg.Org, "org", false, "report on all active accounts of the organization, assuming -role-name role in each")
+	fs.BoolVar(&cfg.Float, "float", false, "in multi-account mode, share regional reservations across accounts in aggregated report, as consolidated billing does")
+	fs.StringVar(&cfg.Format, "format", "text", "report `format`: text, json, csv, markdown, html")
+	fs.StringVar(&cfg.GroupBy, "group-by", "", "group report rows by `attribute`: family collapses instance sizes into families, tag:key splits on-demand instances by tag value")
+	fs.BoolVar(&cfg.Normalized, "normalized", false, "with -group-by family, count instances and reservations in normalized units, 1 unit per nano size")
+	fs.StringVar(&cfg.Addr, "addr", "localhost:9100", "`address` to listen at in serve mode")
+	fs.DurationVar(&cfg.Interval, "interval", 15*time.Minute, "how often to refresh data in serve mode")
+	fs.StringVar(&cfg.CloudWatchNamespace, "cloudwatch-namespace", "", "publish counts as CloudWatch metrics to this `namespace`")
+	fs.DurationVar(&cfg.Watch, "watch", 0, "keep running, reporting repeatedly with this `interval`")
+	fs.BoolVar(&cfg.WatchChanges, "watch-changes", false, "in -watch mode only report when results change")
+	fs.IntVar(&cfg.MaxUncovered, "max-uncovered", 0, "tolerated number of on-demand instances per account and region")
+	fs.IntVar(&cfg.MaxUnused, "max-unused", 0, "tolerated number of unused reservations per account and region")
+	fs.StringVar(&cfg.S3, "s3", "", "upload report to S3 `URL`: s3://bucket/key, or s3://bucket/prefix/ to use generated name")
+}
+
+// config holds settings that alter what is fetched and how it is reported
+type config struct {
+	Service          string       // service to reconcile reservations of, ec2 or one of services
+	DynamoDBReserved capacityList // DynamoDB reserved capacity, it can't be fetched
+	IgnorePlatform   bool         // match instances with reservations regardless of platform
+	StrictTypes      bool         // don't apply size-flexible reservations across sizes
+	IncludeSpot      bool         // count spot instances as demand
+	Spot             bool         // report spot instances separately
+	IncludeStopped   bool         // count stopped instances as demand
+	PaymentPending   bool         // count reservations pending payment as active
+	Listings         bool         // report reservations listed for sale on Reserved Instance Marketplace
+	ExcludeListed    bool         // don't count reservations listed for sale
+
+	Regions      commaList  // if set, each region is reported separately
+	AllRegions   bool       // report on all enabled regions
+	Concurrency  int        // if positive, max number of jobs inspected at once
+	Accounts     commaList  // account ids or role ARNs to assume role in
+	AccountsFile string     // file with more account ids or role ARNs
+	RoleName     string     // role assumed in accounts given by id
+	Org          bool       // report on all organization accounts
+	Float        bool       // pool regional reservations across accounts
+	InstanceIDs  commaList  // if set, only these instances are inspected
+	Types        globList   // if set, only instances and reservations of matching types are inspected
+	ExcludeTypes globList   // instances and reservations of matching types are skipped
+	AZs          commaList  // if set, only instances and AZ-scoped reservations in these zones are inspected
+	Tags         tagList    // if set, only instances having these tags are inspected
+	Filters      filterList // extra DescribeInstances filters
+	ExcludeTags  tagList    // instances having any of these tags are skipped
+	OwnerIDs     commaList  // if set, only instances owned by these accounts are inspected
+	RequesterIDs commaList  // if set, only instances launched by these requesters are inspected
+	Progress     bool       // report fetch progress to stderr
+	Stats        bool       // report API calls statistics to stderr
+	MaxPages     int        // if positive, max number of instance pages to fetch
+	PageSize     int        // if positive, number of instances per page
+
+	Timeout         time.Duration // if positive, time limit of a single report
+	Region          string        // if set, overrides region from environment
+	Profile         string        // if set, shared config profile to use
+	AssumeRole      string        // if set, role ARN assumed on top of base credentials
+	ExternalID      string        // external id used when assuming AssumeRole
+	MFASerial       string        // MFA device used when assuming AssumeRole
+	EndpointURL     string        // if set, used as endpoint of all AWS services
+	MaxRetries      int           // if not negative, max number of API call retries
+	RetryMode       string        // retryStandard or retryAdaptive
+	RetryMaxDelay   time.Duration // if positive, max delay between API call retries
+	HTTPTimeout     time.Duration // if positive, timeout of a single HTTP request
+	HTTPIdleConns   int           // if positive, max idle connections per host
+	HTTPNoKeepAlive bool          // disable HTTP keep-alives
+	Proxy           string        // if set, proxy URL overriding environment
+
+	UserAgentSuffix string // appended to User-Agent after tool identifier
+
+	Output string // if set, report is written to this file
+	Record string // if set, API responses are saved to this directory
+	Replay string // if set, API responses are read from this directory instead of API
+
+	Changes []change // hypothetical changes applied by simulate command
+
+	InstancesFile    string // if set, instances are read from this file instead of API
+	ReservationsFile string // if set, reservations are read from this file instead of API
+	Gzip             bool   // compress report
+
+	EventFile string // if set, JSON event is written here on mismatch
+
+	Webhook         string     // if set, URL to POST mismatch summary to
+	WebhookTemplate string     // file name or built-in template name for webhook payload
+	WebhookHeaders  stringList // extra webhook request headers
+	WebhookRetries  int        // number of webhook request retries
+	SlackWebhook    string     // if set, Slack incoming webhook URL to post mismatch summary to
+	TeamsWebhook    string     // if set, Microsoft Teams incoming webhook URL to post mismatch summary to
+	SNSTopic        string     // if set, SNS topic ARN to publish report to on mismatch
+
+	EmailTo      commaList // if set, report is emailed to these addresses via SES
+	EmailFrom    string    // email sender address
+	EmailSubject string
+
+	MaxUncovered int // tolerated number of on-demand instances
+	MaxUnused    int // tolerated number of unused reservations
+
+	Precision  int    // number of decimal places in percentages
+	Format     string // report format
+	GroupBy    string // attribute report rows are grouped by
+	Normalized bool   // count grouped rows in normalized units
+
+	CloudWatchNamespace string // if set, publish metrics to CloudWatch
+	S3                  string // if set, S3 URL to upload report to
+
+	Watch        time.Duration // if positive, report repeatedly with this interval
+	WatchChanges bool          // in watch mode, only report if there are changes
+
+	Addr     string        // address to listen at in serve mode
+	Interval time.Duration // how often to refresh data in serve mode
+
+	Modifications        bool   // report reservations being modified
+	CapacityReservations bool   // report unused On-Demand Capacity Reservations
+	DedicatedHosts       bool   // report Dedicated Hosts and Dedicated Host Reservations not matching each other
+	ExpiringWithin       days   // if positive, report reservations ending within this period
+	Recommend            bool   // suggest convertible reservation exchanges
+	ExchangeQuotes       bool   // get exchange quotes for suggested exchanges
+	ModifyCommands       bool   // add aws CLI commands to suggested modifications
+	ASGs                 bool   // break down on-demand instances by Auto Scaling group
+	EKS                  bool   // report coverage per Kubernetes cluster and node group
+	Costs                bool   // estimate monthly cost of unused reservations and on-demand instances
+	PriceCache           string // file to cache on-demand rates in
+	Currency             string // currency of cost estimates
+	PaymentOption        string // payment option of offerings recommend command computes break-even for
+
+	CoverageTarget float64 // coverage percentage recommend command aims for
+	CostExplorer   bool    // add Cost Explorer data to report
+	SavingsPlans   bool    // account for on-demand instances covered by Savings Plans
+	LookbackDays   int     // days of usage history Cost Explorer data is based on
+}
+
+// wantEvents reports whether any destination consuming mismatch events is
+// configured
+func (cfg config) wantEvents() bool {
+	return cfg.EventFile != "" || cfg.Webhook != "" || cfg.SlackWebhook != "" || cfg.TeamsWebhook != "" || cfg.SNSTopic != ""
+}
+
+// httpClient returns http client configured according to HTTP-related
+// settings. If none of them are set, it returns nil, so that SDK uses its
+// default client, which honors proxy environment the same way.
+func (cfg config) httpClient() (*http.Client, error) {
+	if cfg.HTTPTimeout <= 0 && cfg.HTTPIdleConns <= 0 && !cfg.HTTPNoKeepAlive && cfg.Proxy == "" {
+		return nil, nil
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %q: must have scheme and host", cfg.Proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	if cfg.HTTPIdleConns > 0 {
+		tr.MaxIdleConnsPerHost = cfg.HTTPIdleConns
+		if tr.MaxIdleConns < cfg.HTTPIdleConns {
+			tr.MaxIdleConns = cfg.HTTPIdleConns
+		}
+	}
+	tr.DisableKeepAlives = cfg.HTTPNoKeepAlive
+	return &http.Client{Transport: tr, Timeout: cfg.HTTPTimeout}, nil
+}
+
+// withTimeout returns ctx limited by cfg.Timeout, if it's set
+func (cfg config) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cfg.Timeout > 0 {
+		return context.WithTimeout(ctx, cfg.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func do(ctx context.Context, w io.Writer, cfg config) error {
+	if _, ok := formatContentTypes[cfg.Format]; !ok {
+		return fmt.Errorf("unsupported format: %q", cfg.Format)
+	}
+	ctx, cancel := cfg.withTimeout(ctx)
+	defer cancel()
+	res, err := collect(ctx, cfg)
 	if err != nil {
 		return err
 	}
-	svc := ec2.New(sess)
-	resp, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{{
-			Name:   aws.String("instance-state-name"),
-			Values: []*string{aws.String("running")},
-		}},
-	})
+	return deliver(ctx, w, cfg, res)
+}
+
+// deliver writes result to w and to other destinations configured by cfg
+func deliver(ctx context.Context, w io.Writer, cfg config, res *result) error {
+	// events are raised for the same reports exit code is based on, so that in
+	// consolidated billing view accounts offsetting each other don't alert
+	var events []*event
+	for _, rep := range res.billed() {
+		if cfg.wantEvents() && rep.exceeds(cfg.MaxUncovered, cfg.MaxUnused) {
+			events = append(events, newEvent(rep, cfg.Precision))
+		}
+	}
+	var buf bytes.Buffer
+	if cfg.S3 != "" || cfg.SNSTopic != "" || len(cfg.EmailTo) > 0 {
+		w = io.MultiWriter(w, &buf)
+	}
+	if err := writeFormat(w, cfg.Format, res); err != nil {
+		return err
+	}
+	if cfg.S3 != "" {
+		if err := uploadReport(ctx, cfg, res.Time, buf.Bytes()); err != nil {
+			return fmt.Errorf("uploading report: %w", err)
+		}
+	}
+	if len(cfg.EmailTo) > 0 {
+		if err := emailReport(ctx, cfg, buf.Bytes()); err != nil {
+			return fmt.Errorf("sending email: %w", err)
+		}
+	}
+	if cfg.CloudWatchNamespace != "" {
+		if err := publishMetrics(ctx, cfg.CloudWatchNamespace, res); err != nil {
+			return fmt.Errorf("publishing metrics: %w", err)
+		}
+	}
+	if err := notify(ctx, cfg, events); err != nil {
+		return err
+	}
+	if cfg.SNSTopic != "" && len(events) > 0 {
+		if err := publishReport(ctx, cfg, buf.Bytes()); err != nil {
+			return fmt.Errorf("publishing to SNS: %w", err)
+		}
+	}
+	if res.exceeds(cfg.MaxUncovered, cfg.MaxUnused) {
+		return errMismatch
+	}
+	return nil
+}
+
+// watch runs reports repeatedly every cfg.Watch until ctx is canceled. Errors
+// are reported to stderr and don't stop it.
+func watch(ctx context.Context, w io.Writer, cfg config) error {
+	if _, ok := formatContentTypes[cfg.Format]; !ok {
+		return fmt.Errorf("unsupported format: %q", cfg.Format)
+	}
+	var last []byte
+	for {
+		if err := watchOnce(ctx, w, cfg, &last); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cfg.Watch):
+		}
+	}
+}
+
+// watchOnce runs a single watch iteration; last holds fingerprint of the
+// previous result
+func watchOnce(ctx context.Context, w io.Writer, cfg config, last *[]byte) error {
+	ctx, cancel := cfg.withTimeout(ctx)
+	defer cancel()
+	res, err := collect(ctx, cfg)
 	if err != nil {
 		return err
 	}
-	runningInstances := make(map[instanceInfo]int)
-	for _, r := range resp.Reservations {
-		for _, inst := range r.Instances {
-			if inst.InstanceLifecycle != nil {
-				continue // skip spot instances
+	fp, _ := json.Marshal(res.Reports) // reports are sorted, so this is stable
+	if cfg.WatchChanges && bytes.Equal(fp, *last) {
+		return nil
+	}
+	*last = fp
+	if cfg.Format == "text" {
+		fmt.Fprintf(w, "=== %s\n", res.Time.Local().Format("2006-01-02 15:04:05"))
+	}
+	if err := deliver(ctx, w, cfg, res); err != nil && !errors.Is(err, errMismatch) {
+		return err
+	}
+	return nil
+}
+
+// newAWSConfig returns AWS config set up according to cfg
+func newAWSConfig(ctx context.Context, cfg config) (aws.Config, error) {
+	if cfg.AssumeRole == "" && (cfg.ExternalID != "" || cfg.MFASerial != "") {
+		return aws.Config{}, errors.New("-external-id and -mfa-serial require -assume-role")
+	}
+	if cfg.RetryMode != "" && cfg.RetryMode != retryStandard && cfg.RetryMode != retryAdaptive {
+		return aws.Config{}, fmt.Errorf("unsupported -retry-mode: %q", cfg.RetryMode)
+	}
+	hc, err := cfg.httpClient()
+	if err != nil {
+		return aws.Config{}, err
+	}
+	apiOptions := []func(*middleware.Stack) error{awsmiddleware.AddUserAgentKey(userAgent)}
+	if cfg.UserAgentSuffix != "" {
+		apiOptions = append(apiOptions, awsmiddleware.AddUserAgentKey(cfg.UserAgentSuffix))
+	}
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithAPIOptions(apiOptions)}
+	if cfg.Profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(cfg.Profile))
+	}
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	if hc != nil {
+		opts = append(opts, awsconfig.WithHTTPClient(hc))
+	}
+	if cfg.EndpointURL != "" {
+		// LocalStack and the like serve all services on a single endpoint
+		opts = append(opts, awsconfig.WithBaseEndpoint(cfg.EndpointURL))
+	}
+	if cfg.MaxRetries >= 0 || cfg.RetryMaxDelay > 0 || cfg.RetryMode == retryAdaptive {
+		opts = append(opts, awsconfig.WithRetryer(func() aws.Retryer {
+			standard := func(o *retry.StandardOptions) {
+				if cfg.MaxRetries >= 0 {
+					o.MaxAttempts = cfg.MaxRetries + 1
+				}
+				if cfg.RetryMaxDelay > 0 {
+					o.MaxBackoff = cfg.RetryMaxDelay
+				}
+			}
+			if cfg.RetryMode == retryAdaptive {
+				return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+					o.StandardOptions = append(o.StandardOptions, standard)
+				})
+			}
+			return retry.NewStandard(standard)
+		}))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil || cfg.AssumeRole == "" {
+		return awsCfg, err
+	}
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), cfg.AssumeRole,
+		func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = userAgent
+			if cfg.ExternalID != "" {
+				o.ExternalID = aws.String(cfg.ExternalID)
+			}
+			if cfg.MFASerial != "" {
+				o.SerialNumber = aws.String(cfg.MFASerial)
+				o.TokenProvider = mfaToken
 			}
-			ii := instanceInfo{Type: *inst.InstanceType, AZ: *inst.Placement.AvailabilityZone}
-			runningInstances[ii] += 1
+		})
+	awsCfg.Credentials = aws.NewCredentialsCache(provider)
+	return awsCfg, nil
+}
+
+// mfaToken prompts for MFA token code on stderr and reads it from stdin, so
+// that prompt doesn't end up in report written to stdout
+func mfaToken() (string, error) {
+	fmt.Fprint(os.Stderr, "MFA token code: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if code := strings.TrimSpace(line); code != "" {
+		return code, nil
+	}
+	if err == nil || err == io.EOF {
+		err = errors.New("empty MFA token code")
+	}
+	return "", err
+}
+
+// collect inspects all accounts and regions set by cfg, and summarizes the
+// result
+func collect(ctx context.Context, cfg config) (*result, error) {
+	res, err := inspectAll(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	res.Summary = res.summarize()
+	res.coverFamilies()
+	if key := cfg.groupTag(); key != "" {
+		res.splitByTag(key)
+	}
+	if cfg.ASGs {
+		res.splitByASG()
+	}
+	if cfg.EKS {
+		res.splitByNodeGroup()
+	}
+	res.GroupBy, res.Normalized = cfg.GroupBy, cfg.Normalized
+	return res, nil
+}
+
+// inspectAll inspects all accounts and regions set by cfg
+func inspectAll(ctx context.Context, cfg config) (*result, error) {
+	if err := cfg.checkService(); err != nil {
+		return nil, err
+	}
+	if cfg.ExchangeQuotes && (!cfg.Recommend || cfg.Replay != "" || cfg.InstancesFile != "" || len(cfg.Changes) > 0) {
+		return nil, errors.New("-exchange-quotes requires -recommend and can't be used with -replay, -instances-file or simulate command")
+	}
+	if cfg.Costs && (cfg.Replay != "" || cfg.InstancesFile != "") {
+		return nil, errors.New("-costs can't be used with -replay or -instances-file")
+	}
+	if cfg.GroupBy != "" && cfg.GroupBy != groupByFamily && cfg.groupTag() == "" {
+		return nil, fmt.Errorf("unsupported -group-by value: %q", cfg.GroupBy)
+	}
+	if cfg.Normalized && cfg.GroupBy != groupByFamily {
+		return nil, errors.New("-normalized requires -group-by family")
+	}
+	if _, ok := pricingRegions[cfg.Currency]; cfg.Costs && !ok {
+		return nil, fmt.Errorf("unsupported -currency %q: Price List API only publishes prices in USD and, for China regions, CNY", cfg.Currency)
+	}
+	if cfg.Replay != "" {
+		jobs, err := replayJobs(cfg.Replay)
+		if err != nil {
+			return nil, err
 		}
+		return inspectJobs(ctx, cfg, jobs, nil)
+	}
+	if cfg.InstancesFile != "" {
+		svc := fileEC2{instances: cfg.InstancesFile, reservations: cfg.ReservationsFile}
+		return inspectJobs(ctx, cfg, []job{{awsCfg: aws.Config{Region: cfg.Region}, svc: svc}}, nil)
+	}
+	awsCfg, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	stats := newAPIStats()
+	awsCfg.APIOptions = append(awsCfg.APIOptions, stats.register)
+	if cfg.Stats {
+		defer stats.WriteTo(os.Stderr)
+	} else {
+		defer stats.warnThrottled(os.Stderr)
+	}
+	var prog *progress
+	if cfg.Progress {
+		if prog = newProgress(os.Stderr); prog != nil {
+			awsCfg.APIOptions = append(awsCfg.APIOptions, prog.registerThrottles)
+		}
+	}
+	accounts, err := targets(ctx, awsCfg, cfg)
+	if err != nil {
+		return nil, err
 	}
+	multiRegion := len(cfg.Regions) > 0 || cfg.AllRegions
+	var jobs []job
+	for _, t := range accounts {
+		regions := []string(cfg.Regions)
+		if cfg.AllRegions {
+			prog.Printf("fetching enabled regions of %s", jobLabel(t.Account, ""))
+			if regions, err = enabledRegions(ctx, t.awsCfg); err != nil {
+				return nil, jobError(t.Account, "", err)
+			}
+		}
+		if !multiRegion {
+			jobs = append(jobs, job{account: t.Account, awsCfg: t.awsCfg, svc: ec2.NewFromConfig(t.awsCfg)})
+			continue
+		}
+		for _, region := range regions {
+			regionCfg := t.awsCfg.Copy()
+			regionCfg.Region = region
+			jobs = append(jobs, job{account: t.Account, region: region, awsCfg: regionCfg, svc: ec2.NewFromConfig(regionCfg)})
+		}
+	}
+	res, err := inspectJobs(ctx, cfg, jobs, prog)
+	if err != nil {
+		return nil, err
+	}
+	if !res.multiAccount && (cfg.Format != "text" || cfg.wantEvents()) {
+		// single account is not known, but is needed for metadata
+		ident, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return nil, err
+		}
+		for _, rep := range res.Reports {
+			rep.Account = aws.ToString(ident.Account)
+		}
+	}
+	if cfg.CostExplorer {
+		prog.Printf("fetching reservation utilization from Cost Explorer")
+		reps := res.Reports
+		if res.float {
+			reps = res.Aggregated
+		}
+		if err := annotateUtilization(ctx, awsCfg, cfg.LookbackDays, reps); err != nil {
+			return nil, fmt.Errorf("cost explorer: %w", err)
+		}
+		prog.Printf("fetching reservation coverage from Cost Explorer")
+		if res.multiAccount {
+			reps = res.Aggregated
+		}
+		if err := compareCoverage(ctx, awsCfg, cfg.LookbackDays, res, reps); err != nil {
+			return nil, fmt.Errorf("cost explorer: %w", err)
+		}
+	}
+	if cfg.SavingsPlans {
+		prog.Printf("fetching Savings Plans coverage from Cost Explorer")
+		if err := annotateSavingsPlans(ctx, awsCfg, cfg.LookbackDays, append(res.Reports, res.Aggregated...)); err != nil {
+			return nil, fmt.Errorf("savings plans: %w", err)
+		}
+		prog.Printf("fetching Savings Plans utilization")
+		if res.SavingsPlans, err = fetchSavingsPlansUsage(ctx, awsCfg, cfg.LookbackDays, res.Reports); err != nil {
+			return nil, fmt.Errorf("savings plans: %w", err)
+		}
+	}
+	if cfg.ASGs {
+		prog.Printf("fetching Auto Scaling groups")
+		if err := annotateDesiredCapacity(ctx, res.Reports); err != nil {
+			return nil, fmt.Errorf("auto scaling: %w", err)
+		}
+	}
+	if cfg.ExchangeQuotes {
+		prog.Printf("fetching reserved instances exchange quotes")
+		if err := quoteExchanges(ctx, res.Reports); err != nil {
+			return nil, fmt.Errorf("exchange quotes: %w", err)
+		}
+	}
+	if cfg.Costs {
+		if chinaRegion(pricingRegions[cfg.Currency]) != chinaRegion(awsCfg.Region) {
+			return nil, fmt.Errorf("-currency %s can't be used in %s: China regions are priced in CNY, other regions in USD",
+				cfg.Currency, awsCfg.Region)
+		}
+		prog.Printf("fetching on-demand prices")
+		rates, err := newOnDemandRates(awsCfg, cfg.Currency, cfg.PriceCache)
+		if err != nil {
+			return nil, fmt.Errorf("price cache: %w", err)
+		}
+		if err := annotateRates(ctx, rates, append(res.Reports, res.Aggregated...)); err != nil {
+			return nil, fmt.Errorf("pricing: %w", err)
+		}
+		if err := rates.save(); err != nil {
+			return nil, fmt.Errorf("price cache: %w", err)
+		}
+		estimateCosts(res, cfg.Currency)
+	}
+	return res, nil
+}
 
-	ris, err := svc.DescribeReservedInstances(&ec2.DescribeReservedInstancesInput{
-		Filters: []*ec2.Filter{{
-			Name:   aws.String("state"),
-			Values: []*string{aws.String("active")},
+// inspectJobs inspects jobs concurrently and combines their reports
+func inspectJobs(ctx context.Context, cfg config, jobs []job, prog *progress) (*result, error) {
+	var multiAccount, multiRegion bool
+	for _, j := range jobs {
+		multiAccount = multiAccount || j.account != ""
+		multiRegion = multiRegion || j.region != ""
+	}
+	if cfg.Service == allServices {
+		jobs = serviceJobs(jobs)
+	}
+	reports := make([]*report, len(jobs))
+	errs := make([]error, len(jobs))
+	limit := cfg.Concurrency
+	if limit <= 0 || limit > len(jobs) {
+		limit = len(jobs)
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var done int
+	var mu sync.Mutex
+	for i, j := range jobs {
+		wg.Add(1)
+		go func(i int, j job) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			svc := j.svc
+			if cfg.Record != "" {
+				svc = newRecorder(svc, filepath.Join(cfg.Record, j.dir()))
+			}
+			name := j.service
+			if name == "" {
+				name = cfg.Service
+			}
+			if _, ok := services[name]; ok {
+				reports[i], errs[i] = inspectService(ctx, name, j.account, j.awsCfg, cfg, prog)
+			} else {
+				reports[i], errs[i] = inspect(ctx, svc, j.awsCfg.Region, cfg, prog)
+			}
+			if reports[i] != nil {
+				if j.service != "" {
+					reports[i].Service = j.service
+				}
+				reports[i].Account = j.account
+				reports[i].awsCfg = j.awsCfg
+			}
+			mu.Lock()
+			done++
+			prog.Printf("%s done (%d/%d)", j, done, len(jobs))
+			mu.Unlock()
+		}(i, j)
+	}
+	wg.Wait()
+	for i := range reports {
+		if err := errs[i]; err != nil {
+			return nil, jobError(jobs[i].account, jobs[i].region, err)
+		}
+	}
+	if len(cfg.Changes) > 0 {
+		if err := applyChanges(cfg, reports); err != nil {
+			return nil, err
+		}
+	}
+	res := &result{
+		Time:         time.Now().UTC(),
+		Reports:      reports,
+		multiAccount: multiAccount,
+		multiRegion:  multiRegion,
+		multiService: cfg.Service == allServices,
+		float:        cfg.Float,
+	}
+	if multiAccount {
+		if cfg.Float {
+			res.Aggregated = floatReports(reports)
+		} else {
+			res.Aggregated = mergeReports(reports)
+		}
+	}
+	return res, nil
+}
+
+// job is a single account and region to inspect
+type job struct {
+	service string // empty for the service of config
+	account string // empty for the account of base config
+	region  string // empty for the region of base config
+	awsCfg  aws.Config
+	svc     ec2API
+}
+
+func (j job) String() string {
+	if j.service != "" {
+		return j.service + " " + jobLabel(j.account, j.region)
+	}
+	return jobLabel(j.account, j.region)
+}
+
+// dir returns directory job responses are recorded to, relative to -record
+// directory: account id (or "default") and region
+func (j job) dir() string {
+	account := j.account
+	if account == "" {
+		account = defaultDir
+	}
+	return filepath.Join(account, j.awsCfg.Region)
+}
+
+// jobLabel returns human-readable account and region combination
+func jobLabel(account, region string) string {
+	var parts []string
+	for _, s := range []string{account, region} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return "default"
+	}
+	return strings.Join(parts, "/")
+}
+
+// jobError annotates err with account and region, if they're set
+func jobError(account, region string, err error) error {
+	if account == "" && region == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", jobLabel(account, region), err)
+}
+
+// enabledRegions returns names of regions enabled for the account: ones that
+// don't require opt-in, and ones opted in
+func enabledRegions(ctx context.Context, awsCfg aws.Config) ([]string, error) {
+	out, err := ec2.NewFromConfig(awsCfg).DescribeRegions(ctx, &ec2.DescribeRegionsInput{
+		AllRegions: aws.Bool(true),
+		Filters: []types.Filter{{
+			Name:   aws.String("opt-in-status"),
+			Values: []string{"opt-in-not-required", "opted-in"},
 		}},
 	})
+	if err != nil {
+		return nil, err
+	}
+	var regions []string
+	for _, r := range out.Regions {
+		regions = append(regions, aws.ToString(r.RegionName))
+	}
+	sort.Strings(regions)
+	return regions, nil
+}
+
+// report is the result of reconciliation within a single region
+type report struct {
+	Service string `json:"service,omitempty"` // empty for EC2, see -service
+	Account string `json:"account,omitempty"` // empty for the account of base config
+	Region  string `json:"region"`
+	reservations.Result
+	Modifications []pendingModification    `json:"modifications,omitempty"`
+	Exchanges     []exchangeSuggestion     `json:"exchanges,omitempty"`
+	Suggested     []modificationSuggestion `json:"suggestedModifications,omitempty"` // only set with -recommend
+	Coverage      []typeCoverage           `json:"coverage,omitempty"`               // only set with -cost-explorer
+	Families      []familyCoverage         `json:"families,omitempty"`
+	TagKey        string                   `json:"tagKey,omitempty"` // only set with -group-by tag:key
+	ByTag         []tagReport              `json:"byTag,omitempty"`
+
+	// only set with -asgs
+	ASGs          []tagReport    `json:"autoScalingGroups,omitempty"`
+	ASGShortfalls []asgShortfall `json:"autoScalingShortfalls,omitempty"`
+
+	NodeGroups []tagReport `json:"nodeGroups,omitempty"` // only set with -eks
+
+	CapacityReservations []capacityReservation `json:"capacityReservations,omitempty"` // unused ones, only set with -capacity-reservations
+	CapacityBlocks       []capacityBlock       `json:"capacityBlocks,omitempty"`       // only set with -capacity-reservations
+	CapacityFleets       []capacityFleet       `json:"capacityFleets,omitempty"`       // only set with -capacity-reservations
+
+	OfferingClasses []offeringClasses `json:"offeringClasses,omitempty"` // only set if there are convertible reservations
+
+	Expiring []reservationTerm `json:"expiring,omitempty"` // only set with -expiring-within
+	Incoming []reservationTerm `json:"incoming,omitempty"` // queued purchases
+	Listed   []reservationTerm `json:"listed,omitempty"`   // listed for sale, only set with -listings or -exclude-listed
+
+	// only set with -dedicated-hosts
+	DedicatedHosts         []dedicatedHost   `json:"dedicatedHosts,omitempty"` // without reservation
+	UnusedHostReservations []hostReservation `json:"unusedHostReservations,omitempty"`
+
+	Cost *costEstimate `json:"cost,omitempty"` // only set with -costs
+
+	inv    *reservations.Inventory    // instances report was made from
+	ris    *reservations.Reservations // reservations report was made from
+	awsCfg aws.Config                 // AWS config report was made with
+
+	desired map[string]int // desired capacity of Auto Scaling groups, only fetched with -asgs
+}
+
+// exceeds reports whether number of on-demand instances not covered by
+// Savings Plans or unused reservations is above tolerated maximum
+func (r *report) exceeds(maxUncovered, maxUnused int) bool {
+	return r.Uncovered()-r.savingsPlansCovered() > maxUncovered || r.Unused() > maxUnused
+}
+
+// ec2API is the subset of EC2 API inspect uses, *ec2.Client implements it
+type ec2API interface {
+	reservations.EC2API
+	ec2.DescribeReservedInstancesModificationsAPIClient
+	ec2.DescribeCapacityReservationsAPIClient
+	ec2.DescribeCapacityReservationFleetsAPIClient
+	ec2.DescribeHostsAPIClient
+	ec2.DescribeHostReservationsAPIClient
+	DescribeReservedInstancesListings(ctx context.Context, params *ec2.DescribeReservedInstancesListingsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesListingsOutput, error)
+}
+
+// inspect fetches instances and reservations of given region using svc and
+// reconciles them
+func inspect(ctx context.Context, svc ec2API, region string, cfg config, prog *progress) (*report, error) {
+	rep := &report{Region: region}
+	input := &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: []string{"running"},
+		}},
+	}
+	if cfg.IncludeStopped {
+		input.Filters[0].Values = append(input.Filters[0].Values, "stopped")
+	}
+	if len(cfg.InstanceIDs) > 0 {
+		input.InstanceIds = cfg.InstanceIDs
+	} else if cfg.PageSize > 0 {
+		// API doesn't allow MaxResults together with InstanceIds
+		input.MaxResults = aws.Int32(int32(cfg.PageSize))
+	}
+	if len(cfg.OwnerIDs) > 0 {
+		input.Filters = append(input.Filters, types.Filter{
+			Name:   aws.String("owner-id"),
+			Values: cfg.OwnerIDs,
+		})
+	}
+	if len(cfg.RequesterIDs) > 0 {
+		input.Filters = append(input.Filters, types.Filter{
+			Name:   aws.String("requester-id"),
+			Values: cfg.RequesterIDs,
+		})
+	}
+	if len(cfg.AZs) > 0 {
+		input.Filters = append(input.Filters, types.Filter{
+			Name:   aws.String("availability-zone"),
+			Values: cfg.AZs,
+		})
+	}
+	input.Filters = append(input.Filters, cfg.Tags.filters()...)
+	input.Filters = append(input.Filters, cfg.Filters...)
+	opts := cfg.options()
+	opts.MaxPages = cfg.MaxPages
+	opts.Logf = prog.Printf
+	if len(cfg.ExcludeTags) > 0 {
+		opts.Skip = func(inst *types.Instance) bool { return hasAnyTag(inst.Tags, cfg.ExcludeTags) }
+	}
+	// reservations are fetched concurrently with instances; the fetch is
+	// canceled and waited for if instances can't be fetched
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var ris *reservations.Reservations
+	var crs *capacity
+	var risErr error
+	risDone := make(chan struct{})
+	go func() {
+		defer close(risDone)
+		ropts := opts
+		if cfg.Listings || cfg.ExcludeListed {
+			prog.Printf("fetching reserved instances marketplace listings")
+			if ropts.Listed, risErr = fetchListings(ctx, svc); risErr != nil {
+				return
+			}
+		}
+		if ris, risErr = reservations.FetchReservations(ctx, svc, ropts); risErr != nil {
+			return
+		}
+		if cfg.Modifications {
+			prog.Printf("fetching pending reserved instances modifications")
+			if rep.Modifications, risErr = fetchPendingModifications(ctx, svc); risErr != nil {
+				return
+			}
+		}
+		if cfg.CapacityReservations {
+			prog.Printf("fetching capacity reservations")
+			if crs, risErr = fetchCapacityReservations(ctx, svc, opts); risErr != nil {
+				return
+			}
+			rep.CapacityBlocks = crs.blocks
+			prog.Printf("fetching capacity reservation fleets")
+			if rep.CapacityFleets, risErr = fetchCapacityFleets(ctx, svc, crs.fleetInUse); risErr != nil {
+				return
+			}
+		}
+		if cfg.DedicatedHosts {
+			prog.Printf("fetching dedicated hosts")
+			rep.DedicatedHosts, rep.UnusedHostReservations, risErr = fetchDedicatedHosts(ctx, svc, cfg.AZs)
+		}
+	}()
+	inv, err := reservations.FetchInventory(ctx, svc, input, opts)
+	if err != nil {
+		cancel()
+		<-risDone
+		return nil, err
+	}
+	if inv.Truncated {
+		fmt.Fprintf(os.Stderr, "WARNING: %s: stopped after %d pages of instances, report is incomplete\n", rep.Region, cfg.MaxPages)
+	}
+	<-risDone
+	if risErr != nil {
+		return nil, risErr
+	}
+	rep.inv, rep.ris = inv, ris
+	if crs != nil {
+		rep.CapacityReservations = unusedCapacity(crs.reservations, inv)
+	}
+	rep.reconcile(cfg)
+	return rep, nil
+}
+
+// service returns name of the service report is on, ec2 for EC2 reports
+func (rep *report) service() string {
+	if rep.Service == "" {
+		return "ec2"
+	}
+	return rep.Service
+}
+
+// reconcile fills report from its inventory and reservations
+func (rep *report) reconcile(cfg config) {
+	rep.Result = *reservations.Reconcile(rep.inv, rep.ris)
+	rep.OfferingClasses = countOfferingClasses(rep.ris.Terms)
+	rep.Incoming = incomingReservations(rep.ris)
+	rep.Listed = listedReservations(rep.ris)
+	if cfg.ExpiringWithin > 0 {
+		rep.Expiring = expiringReservations(rep.ris, time.Now().Add(time.Duration(cfg.ExpiringWithin)))
+	}
+	if cfg.Recommend {
+		rep.Exchanges = suggestExchanges(rep.OnDemandInstances, rep.UnusedReservations, rep.ris.Convertible)
+		moves := suggestMoves(rep.OnDemandInstances, rep.UnusedReservations, rep.ris.Terms)
+		rep.Suggested = append(moves, suggestRegional(rep.OnDemandInstances, rep.UnusedReservations, rep.ris.Terms, moves)...)
+		sort.SliceStable(rep.Suggested, func(i, j int) bool { return rep.Suggested[i].Reservation < rep.Suggested[j].Reservation })
+		if cfg.ModifyCommands {
+			modifyCommands(rep.Region, rep.Suggested, rep.ris.Terms)
+		}
+	}
+}
+
+// options returns options of counting instances and reservations set by cfg
+func (cfg config) options() reservations.Options {
+	return reservations.Options{
+		IgnorePlatform: cfg.IgnorePlatform,
+		StrictTypes:    cfg.StrictTypes,
+		IncludeSpot:    cfg.IncludeSpot,
+		Spot:           cfg.Spot,
+		PaymentPending: cfg.PaymentPending,
+		ExcludeListed:  cfg.ExcludeListed,
+		Types:          cfg.Types,
+		ExcludeTypes:   cfg.ExcludeTypes,
+		AZs:            cfg.AZs,
+		GroupTag:       cfg.groupTag(),
+		AutoScaling:    cfg.ASGs,
+		Kubernetes:     cfg.EKS,
+	}
+}
+
+// notify writes events to file and posts them to webhook, if these are
+// configured
+func notify(ctx context.Context, cfg config, events []*event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	hc, err := cfg.httpClient()
 	if err != nil {
 		return err
 	}
-	// Match these:
-	// InstanceType: "t2.xlarge",
-	// InstanceCount: 1,
-	//
-	// Two possible cases:
-	// 1.  Scope: "Availability Zone", AvailabilityZone: "us-east-1e",
-	// 2.  Scope: "Region",
-	azReservations := make(map[instanceInfo]int)
-	regionReservations := make(map[instanceInfo]int)
-	for _, r := range ris.ReservedInstances {
-		switch *r.Scope {
-		case "Region":
-			ii := instanceInfo{Type: *r.InstanceType}
-			regionReservations[ii] += int(*r.InstanceCount)
-		case "Availability Zone":
-			ii := instanceInfo{Type: *r.InstanceType, AZ: *r.AvailabilityZone}
-			azReservations[ii] += int(*r.InstanceCount)
-		default:
-			return fmt.Errorf("unknown reservation scope: %q", *r.Scope)
-		}
-	}
-	var onDemandInstances []reportedInfo
-	var unusedReservations []reportedInfo
-	for k, v := range reconcile(runningInstances, azReservations, regionReservations) {
-		switch {
-		case v < 0:
-			ri := reportedInfo{Type: k.Type, AZ: k.AZ, Count: -v}
-			onDemandInstances = append(onDemandInstances, ri)
-		case v > 0:
-			ri := reportedInfo{Type: k.Type, Count: v}
-			unusedReservations = append(unusedReservations, ri)
-		}
-	}
-	sort.SliceStable(onDemandInstances,
-		func(i, j int) bool { return onDemandInstances[i].Type < onDemandInstances[j].Type })
-	sort.SliceStable(unusedReservations,
-		func(i, j int) bool { return unusedReservations[i].Type < unusedReservations[j].Type })
-	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
-	if len(onDemandInstances) > 0 {
-		fmt.Fprintln(tw, "On-demand EC2 instances:")
-	}
-	for _, v := range onDemandInstances {
-		fmt.Fprintf(tw, "%s\t%d\t%s\n", v.Type, v.Count, v.AZ)
-	}
-	if len(unusedReservations) > 0 {
-		fmt.Fprintln(tw, "Unused reservations:")
-	}
-	for _, v := range unusedReservations {
-		fmt.Fprintf(tw, "%s\t%d\n", v.Type, v.Count)
-	}
-	return tw.Flush()
-}
-
-type instanceInfo struct {
-	Type string
-	AZ   string
-}
-
-type reportedInfo struct {
-	Type  string
-	AZ    string
-	Count int
-}
-
-// algorithm:
-// 1. fetch all reserved instances info, put them into 2 maps: one for AZ-scoped
-// reservations, one for Region-scoped reservations. Key of map is a struct,
-// value is number of instances.
-// 2. fetch all running instances info
-// 3. for each running instance info decrease number in AZ-scoped reservations,
-// so that final form of AZ-scoped reservations would contain positive values
-// for unused reservations, and negative values for running instances w/o
-// reservations.
-// 4. iterate over k/v pairs with NEGATIVE values in AZ-scoped map, try to add
-// values from Region-scoped reservations map.
-
-func reconcile(runningInstances, azReservations, regionReservations map[instanceInfo]int) map[instanceInfo]int {
-	out := make(map[instanceInfo]int, len(runningInstances))
-	for k, v := range runningInstances {
-		out[k] = -v
-	}
-	for k, v := range azReservations {
-		out[k] += v
-	}
-	for k, v := range out {
-		if v >= 0 { // only process items that really lacks reservations
-			continue
+	if cfg.EventFile != "" {
+		if err := writeEvents(cfg.EventFile, events); err != nil {
+			return fmt.Errorf("writing events: %w", err)
+		}
+	}
+	if cfg.Webhook != "" {
+		for _, ev := range events {
+			wh := webhook{
+				URL:      cfg.Webhook,
+				Template: cfg.WebhookTemplate,
+				Headers:  cfg.WebhookHeaders,
+				Retries:  cfg.WebhookRetries,
+			}
+			if err := postWebhook(ctx, hc, wh, ev); err != nil {
+				return fmt.Errorf("webhook: %w", err)
+			}
+		}
+	}
+	if cfg.TeamsWebhook != "" {
+		for _, ev := range events {
+			wh := webhook{URL: cfg.TeamsWebhook, Template: "teams", Retries: cfg.WebhookRetries}
+			if err := postWebhook(ctx, hc, wh, ev); err != nil {
+				return fmt.Errorf("teams: %w", err)
+			}
 		}
-		// fmt.Printf("k=%v, v=%d\n", k, v)
-		k2 := instanceInfo{Type: k.Type}
-		if v2, ok := regionReservations[k2]; ok {
-			need, have := -v, v2
-			switch {
-			case need >= have:
-				out[k] = v + v2
-				delete(regionReservations, k2)
-			default:
-				out[k] += need
-				regionReservations[k2] -= need
+	}
+	if cfg.SlackWebhook != "" {
+		for _, ev := range events {
+			wh := webhook{URL: cfg.SlackWebhook, Template: "slack", Retries: cfg.WebhookRetries}
+			if err := postWebhook(ctx, hc, wh, ev); err != nil {
+				return fmt.Errorf("slack: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// percent returns part as percentage of total rounded to given number of
+// decimal places. Empty total is considered fully covered.
+func percent(part, total, precision int) float64 {
+	if total == 0 {
+		return 100
+	}
+	if precision < 0 {
+		precision = 0
+	}
+	p := math.Pow10(precision)
+	return math.Round(float64(part)/float64(total)*100*p) / p
+}
+
+// progress reports fetch progress in human-readable form. Its methods are
+// safe to call on nil value, they do nothing in this case.
+type progress struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newProgress returns progress writing to f, or nil if f is not a terminal, so
+// that progress messages don't pollute logs of non-interactive runs.
+func newProgress(f *os.File) *progress {
+	if st, err := f.Stat(); err != nil || st.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progress{w: f}
+}
+
+func (p *progress) Printf(format string, args ...interface{}) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, format+"\n", args...)
+}
+
+// apiStats counts API calls per operation. Every page of paginated API is
+// counted as a separate call.
+type apiStats struct {
+	mu        sync.Mutex
+	calls     map[string]int
+	retries   map[string]int
+	throttles map[string]int
+}
+
+func newAPIStats() *apiStats {
+	return &apiStats{
+		calls:     make(map[string]int),
+		retries:   make(map[string]int),
+		throttles: make(map[string]int),
+	}
+}
+
+// register adds middleware recording every attempt of API call to stack; it's
+// meant to be added to aws.Config.APIOptions, which are applied to a fresh
+// stack on each call
+func (s *apiStats) register(stack *middleware.Stack) error {
+	var attempts int
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("apiStats",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleFinalize(ctx, in)
+			attempts++
+			op := awsmiddleware.GetOperationName(ctx)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if attempts == 1 {
+				s.calls[op]++
+			} else {
+				s.retries[op]++
+			}
+			if isThrottle(err) {
+				s.throttles[op]++
+			}
+			return out, md, err
+		}), "Retry", middleware.After)
+}
+
+// registerThrottles adds middleware reporting throttled API calls to stack;
+// it's meant to be added to aws.Config.APIOptions
+func (p *progress) registerThrottles(stack *middleware.Stack) error {
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("progressThrottles",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleFinalize(ctx, in)
+			if isThrottle(err) {
+				p.Printf("%s throttled", awsmiddleware.GetOperationName(ctx))
 			}
-			// fmt.Printf("k=%v, v=%d, v2=%d\n", k, v, v2)
+			return out, md, err
+		}), "Retry", middleware.After)
+}
+
+// isThrottle reports whether err is caused by API throttling
+func isThrottle(err error) bool {
+	return err != nil && retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary
+}
+
+// warnThrottled writes a warning to w if any API calls were throttled, so that
+// throttling is noticed in logs of non-interactive runs too
+func (s *apiStats) warnThrottled(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, v := range s.throttles {
+		n += v
+	}
+	if n > 0 {
+		fmt.Fprintf(w, "WARNING: %d API calls throttled, consider -retry-mode adaptive or lower -concurrency\n", n)
+	}
+}
+
+func (s *apiStats) WriteTo(w io.Writer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.calls))
+	for k := range s.calls {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var total int64
+	for _, name := range names {
+		n, err := fmt.Fprintf(w, "API calls: %s\t%d (%d retries, %d throttled)\n",
+			name, s.calls[name], s.retries[name], s.throttles[name])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// stringList is a flag.Value holding values of repeated flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// commaList is a flag.Value holding list of values given as comma-separated
+// string; it may be set multiple times, values accumulate
+type commaList []string
+
+func (c *commaList) String() string { return strings.Join(*c, ",") }
+
+func (c *commaList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*c = append(*c, v)
 		}
 	}
-	for k, v := range regionReservations {
-		out[k] = v
+	return nil
+}
+
+// has reports whether list includes s
+func (c commaList) has(s string) bool {
+	for _, v := range c {
+		if v == s {
+			return true
+		}
 	}
-	return out
+	return false
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parseConfig returns config set by command line args the way main does
+func parseConfig(t *testing.T, args ...string) config {
+	t.Helper()
+	var cfg config
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	cfg.register(fs)
+	if err := fs.Parse(append([]string{"-price-cache", ""}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// In consolidated billing view reservations of one account cover instances
+// of another, so neither the exit code nor events should report a mismatch.
+func TestDeliverFloat(t *testing.T) {
+	for _, float := range []bool{false, true} {
+		eventFile := filepath.Join(t.TempDir(), "event.json")
+		args := []string{"-replay", "testdata/float", "-event-file", eventFile}
+		if float {
+			args = append(args, "-float")
+		}
+		cfg := parseConfig(t, args...)
+		ctx := context.Background()
+		res, err := collect(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = deliver(ctx, io.Discard, cfg, res)
+		_, statErr := os.Stat(eventFile)
+		switch {
+		case float && (err != nil || statErr == nil):
+			t.Errorf("-float: got error %v, event file written %v; want no mismatch", err, statErr == nil)
+		case !float && (!errors.Is(err, errMismatch) || statErr != nil):
+			t.Errorf("got error %v, event file error %v; want mismatch reported", err, statErr)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// splitByNodeGroup sets on-demand instances of EC2 reports in res attributed
+// to Kubernetes node groups, see splitByTag. Node groups with lowest coverage
+// come first, instances not being nodes are left out.
+func (res *result) splitByNodeGroup() {
+	res.split(func(inv *reservations.Inventory) map[string]map[reservations.Key]int { return inv.Kubernetes },
+		func(rep *report, trs []tagReport) {
+			rep.NodeGroups = nil
+			for _, t := range trs {
+				if t.Value != "" {
+					rep.NodeGroups = append(rep.NodeGroups, t)
+				}
+			}
+			sort.SliceStable(rep.NodeGroups, func(i, j int) bool { return rep.NodeGroups[i].Coverage < rep.NodeGroups[j].Coverage })
+		})
+}
+
+func writeNodeGroups(w io.Writer, trs []tagReport, currency string) {
+	if len(trs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Coverage by Kubernetes cluster and node group:")
+	for _, t := range trs {
+		writeTagReport(w, fmt.Sprintf("%s\t%g%%", t.Value, t.Coverage), t, currency)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/elasticache"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// ElastiCache reserved cache nodes are Region-scoped and cover nodes of the
+// same engine (reservation product description). They're size flexible within
+// node type family, using the same normalization factors EC2 does.
+
+// fetchElastiCache counts cache nodes and active reserved cache nodes
+func fetchElastiCache(ctx context.Context, account string, awsCfg aws.Config, cfg config, prog *progress) (*reservations.Inventory, *reservations.Reservations, error) {
+	svc := elasticache.NewFromConfig(awsCfg)
+	opts := cfg.options()
+	inv := reservations.NewInventory()
+	prog.Printf("fetching ElastiCache clusters in %s", awsCfg.Region)
+	p := elasticache.NewDescribeCacheClustersPaginator(svc, &elasticache.DescribeCacheClustersInput{})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range page.CacheClusters {
+			typ := aws.ToString(c.CacheNodeType)
+			if !opts.TypeSelected(typ) {
+				continue
+			}
+			k := reservations.Key{Type: typ}
+			if !opts.IgnorePlatform {
+				k.Platform = aws.ToString(c.Engine)
+			}
+			// memcached clusters may have nodes in several zones
+			if az := aws.ToString(c.PreferredAvailabilityZone); az != "Multiple" {
+				k.AZ = az
+			}
+			inv.Running[k] += int(aws.ToInt32(c.NumCacheNodes))
+		}
+	}
+	prog.Printf("fetching ElastiCache reserved cache nodes in %s", awsCfg.Region)
+	ris := reservations.NewReservations()
+	rp := elasticache.NewDescribeReservedCacheNodesPaginator(svc, &elasticache.DescribeReservedCacheNodesInput{})
+	for rp.HasMorePages() {
+		page, err := rp.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range page.ReservedCacheNodes {
+			typ := aws.ToString(r.CacheNodeType)
+			if !opts.Active(aws.ToString(r.State)) || !opts.TypeSelected(typ) {
+				continue
+			}
+			k := reservations.Key{Type: typ}
+			if !opts.IgnorePlatform {
+				k.Platform = aws.ToString(r.ProductDescription)
+			}
+			n := int(aws.ToInt32(r.CacheNodeCount))
+			if !opts.StrictTypes && reservations.SizeUnits(typ) > 0 {
+				ris.AddFlexible(typ, k.Platform, n)
+				continue
+			}
+			ris.Region[k] += n
+		}
+	}
+	return inv, ris, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// emailReport sends rendered report by email through SES. Report rendered as
+// html is sent as HTML body, any other format as plain text.
+func emailReport(ctx context.Context, cfg config, body []byte) error {
+	if cfg.EmailFrom == "" {
+		return fmt.Errorf("sender address must be set")
+	}
+	awsCfg, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	content := &sestypes.Content{Data: aws.String(string(body)), Charset: aws.String("UTF-8")}
+	msg := &sestypes.Message{
+		Subject: &sestypes.Content{Data: aws.String(cfg.EmailSubject), Charset: aws.String("UTF-8")},
+		Body:    &sestypes.Body{Text: content},
+	}
+	if cfg.Format == "html" {
+		msg.Body = &sestypes.Body{Html: content}
+	}
+	_, err = ses.NewFromConfig(awsCfg).SendEmail(ctx, &ses.SendEmailInput{
+		Source:      aws.String(cfg.EmailFrom),
+		Destination: &sestypes.Destination{ToAddresses: cfg.EmailTo},
+		Message:     msg,
+	})
+	return err
+}
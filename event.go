@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// event is a machine-readable summary of mismatch found, meant to be consumed
+// by automation subscribed to some event bus
+type event struct {
+	Type     string    `json:"type"`
+	Severity string    `json:"severity"`
+	Time     time.Time `json:"time"`
+	Service  string    `json:"service,omitempty"` // empty for EC2, see -service
+	Region   string    `json:"region"`
+	Account  string    `json:"account"`
+
+	Running   int     `json:"running"`   // total number of inspected instances
+	Uncovered int     `json:"uncovered"` // total number of on-demand instances
+	Unused    int     `json:"unused"`    // total number of unused reservations
+	Coverage  float64 `json:"coverage"`  // percentage of running instances covered
+
+	OnDemandInstances  []reservations.Item `json:"onDemandInstances,omitempty"`
+	UnusedReservations []reservations.Item `json:"unusedReservations,omitempty"`
+}
+
+const eventTypeMismatch = "ec2-reservations.mismatch"
+
+// newEvent returns mismatch event for report; precision is the number of
+// decimal places of percentages
+func newEvent(rep *report, precision int) *event {
+	ev := &event{
+		Type:               eventTypeMismatch,
+		Severity:           "warning",
+		Time:               time.Now().UTC(),
+		Service:            rep.Service,
+		Region:             rep.Region,
+		Account:            rep.Account,
+		Running:            rep.Running,
+		Uncovered:          rep.Uncovered(),
+		Unused:             rep.Unused(),
+		OnDemandInstances:  rep.OnDemandInstances,
+		UnusedReservations: rep.UnusedReservations,
+	}
+	ev.Coverage = percent(rep.Running-ev.Uncovered, rep.Running, precision)
+	return ev
+}
+
+// Title returns short description of event naming the service it's about,
+// i.e. "RDS reservations mismatch"
+func (ev *event) Title() string {
+	return serviceTitle(ev.Service) + " reservations mismatch"
+}
+
+// writeEvents writes events as a stream of JSON objects to named file, or to
+// stdout if name is "-"
+func writeEvents(name string, events []*event) error {
+	f := os.Stdout
+	if name != "-" {
+		var err error
+		if f, err = os.Create(name); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	if name != "-" {
+		return f.Close()
+	}
+	return nil
+}
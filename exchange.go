@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// exchangeAPI is the subset of EC2 API exchange quotes need
+type exchangeAPI interface {
+	ec2.DescribeReservedInstancesOfferingsAPIClient
+	GetReservedInstancesExchangeQuote(ctx context.Context, params *ec2.GetReservedInstancesExchangeQuoteInput, optFns ...func(*ec2.Options)) (*ec2.GetReservedInstancesExchangeQuoteOutput, error)
+}
+
+// exchangeQuote is a concrete exchange proposal for exchangeSuggestion, as
+// quoted by GetReservedInstancesExchangeQuote
+type exchangeQuote struct {
+	Source      []string `json:"source"`      // ids of convertible reservations to exchange, whole
+	SourceCount int      `json:"sourceCount"` // number of instances they reserve
+	Offering    string   `json:"offering"`    // target offering id
+	Type        string   `json:"type"`        // target instance type
+	Count       int      `json:"count"`       // target instance count
+	Valid       bool     `json:"valid"`
+	Reason      string   `json:"reason,omitempty"` // why exchange is not valid
+	PaymentDue  string   `json:"paymentDue,omitempty"`
+	Currency    string   `json:"currency,omitempty"`
+}
+
+// quoteExchanges gets exchange quotes for exchange suggestions of reports
+func quoteExchanges(ctx context.Context, reps []*report) error {
+	for _, rep := range reps {
+		if len(rep.Exchanges) == 0 {
+			continue
+		}
+		svc := ec2.NewFromConfig(rep.awsCfg)
+		for i := range rep.Exchanges {
+			q, err := quoteExchange(ctx, svc, rep, rep.Exchanges[i])
+			if err != nil {
+				return jobError(rep.Account, rep.Region, err)
+			}
+			rep.Exchanges[i].Quote = q
+		}
+	}
+	return nil
+}
+
+// quoteExchange picks whole convertible reservations of s.From type adding up
+// to at least s.Count instances, and quotes their exchange for reservations
+// of the most common on-demand instance type of s.ToFamily, with the same
+// normalized size. It returns nil if there's no matching reservations or
+// target offering.
+func quoteExchange(ctx context.Context, svc exchangeAPI, rep *report, s exchangeSuggestion) (*exchangeQuote, error) {
+	var target reservations.Item
+	for _, v := range rep.OnDemandInstances {
+		if reservations.Family(v.Type) == s.ToFamily && v.Count > target.Count {
+			target = v
+		}
+	}
+	if target.Count == 0 {
+		return nil, nil
+	}
+	var terms []reservations.Term
+	for _, t := range rep.ris.Terms {
+		if t.Convertible && t.Key.Type == s.From && t.Count > 0 {
+			terms = append(terms, t)
+		}
+	}
+	// reservations ending soonest are the cheapest to give up
+	sort.SliceStable(terms, func(i, j int) bool { return terms[i].End.Before(terms[j].End) })
+	q := &exchangeQuote{Type: target.Type}
+	var end time.Time
+	for _, t := range terms {
+		if q.SourceCount >= s.Count {
+			break
+		}
+		q.Source = append(q.Source, t.ID)
+		q.SourceCount += t.Count
+		if t.End.After(end) {
+			end = t.End
+		}
+	}
+	if len(q.Source) == 0 {
+		return nil, nil
+	}
+	q.Count = q.SourceCount
+	if from, to := reservations.SizeUnits(s.From), reservations.SizeUnits(target.Type); from > 0 && to > 0 {
+		q.Count = int(math.Ceil(float64(q.SourceCount*from) / float64(to)))
+	}
+	if q.Count > target.Count {
+		q.Count = target.Count
+	}
+	offering, err := exchangeOffering(ctx, svc, target, time.Until(end))
+	if err != nil {
+		return nil, err
+	}
+	if offering == "" {
+		return nil, nil
+	}
+	q.Offering = offering
+	out, err := svc.GetReservedInstancesExchangeQuote(ctx, &ec2.GetReservedInstancesExchangeQuoteInput{
+		ReservedInstanceIds: q.Source,
+		TargetConfigurations: []types.TargetConfigurationRequest{{
+			OfferingId:    aws.String(offering),
+			InstanceCount: aws.Int32(int32(q.Count)),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.Valid = aws.ToBool(out.IsValidExchange)
+	q.Reason = aws.ToString(out.ValidationFailureReason)
+	q.PaymentDue = aws.ToString(out.PaymentDue)
+	q.Currency = aws.ToString(out.CurrencyCode)
+	return q, nil
+}
+
+// exchangeOffering returns id of Region-scoped no upfront convertible
+// offering for instances like it, with the shortest term not shorter than
+// remaining, since exchange can't shorten the term. It returns empty string
+// if there's no such offering.
+func exchangeOffering(ctx context.Context, svc exchangeAPI, it reservations.Item, remaining time.Duration) (string, error) {
+	input := &ec2.DescribeReservedInstancesOfferingsInput{
+		InstanceType:       types.InstanceType(it.Type),
+		OfferingClass:      types.OfferingClassTypeConvertible,
+		OfferingType:       types.OfferingTypeValuesNoUpfront,
+		ProductDescription: types.RIProductDescription(it.Platform),
+		IncludeMarketplace: aws.Bool(false),
+		MinDuration:        aws.Int64(int64(remaining.Seconds())),
+		Filters: []types.Filter{{
+			Name:   aws.String("scope"),
+			Values: []string{string(types.ScopeRegional)},
+		}},
+	}
+	if input.ProductDescription == "" {
+		input.ProductDescription = reservations.LinuxPlatform
+	}
+	if it.Tenancy != "" {
+		input.InstanceTenancy = types.Tenancy(it.Tenancy)
+	}
+	var id string
+	var duration int64
+	paginator := ec2.NewDescribeReservedInstancesOfferingsPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, o := range page.ReservedInstancesOfferings {
+			if d := aws.ToInt64(o.Duration); id == "" || d < duration {
+				id, duration = aws.ToString(o.ReservedInstancesOfferingId), d
+			}
+		}
+	}
+	return id, nil
+}
+
+func writeExchangeQuote(w io.Writer, q *exchangeQuote) {
+	if q == nil {
+		return
+	}
+	fmt.Fprintf(w, "\t%v (%d instances)\t-> %d %s\t%s", q.Source, q.SourceCount, q.Count, q.Type, q.Offering)
+	switch {
+	case !q.Valid:
+		fmt.Fprintf(w, "\tnot valid: %s\n", q.Reason)
+	case q.PaymentDue != "":
+		fmt.Fprintf(w, "\tpayment due %s %s\n", q.PaymentDue, q.Currency)
+	default:
+		fmt.Fprintln(w, "\tno payment due")
+	}
+}
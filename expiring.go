@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// days is a flag.Value holding duration which may also be given in days,
+// i.e. 30d
+type days time.Duration
+
+func (d *days) String() string {
+	if *d > 0 && time.Duration(*d)%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(time.Duration(*d)/(24*time.Hour))) + "d"
+	}
+	return time.Duration(*d).String()
+}
+
+func (d *days) Set(s string) error {
+	if strings.HasSuffix(s, "d") {
+		v, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid number of days: %q", s)
+		}
+		*d = days(time.Duration(v) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = days(v)
+	return nil
+}
+
+// reservationTerm is a number of reservations bought together, reported as
+// expiring or incoming
+type reservationTerm struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	AZ       string    `json:"az,omitempty"`
+	Platform string    `json:"platform,omitempty"`
+	Tenancy  string    `json:"tenancy,omitempty"`
+	Count    int       `json:"count"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+func newReservationTerm(t reservations.Term) reservationTerm {
+	return reservationTerm{
+		ID:       t.ID,
+		Type:     t.Key.Type,
+		AZ:       t.Key.AZ,
+		Platform: t.Key.Platform,
+		Tenancy:  t.Key.Tenancy,
+		Count:    t.Count,
+		Start:    t.Start,
+		End:      t.End,
+	}
+}
+
+// expiringReservations returns reservations of ris ending before deadline,
+// soonest first
+func expiringReservations(ris *reservations.Reservations, deadline time.Time) []reservationTerm {
+	var out []reservationTerm
+	for _, t := range ris.Terms {
+		// reservations added by simulate command have no end date
+		if t.End.IsZero() || t.Count <= 0 || !t.End.Before(deadline) {
+			continue
+		}
+		out = append(out, newReservationTerm(t))
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].End.Before(out[j].End) })
+	return out
+}
+
+// incomingReservations returns queued purchases of ris, starting soonest
+// first
+func incomingReservations(ris *reservations.Reservations) []reservationTerm {
+	var out []reservationTerm
+	for _, t := range ris.Queued {
+		out = append(out, newReservationTerm(t))
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// endNote returns note on when unused reservations end, if it's known
+func endNote(v reservations.Item) string {
+	if v.End == nil {
+		return ""
+	}
+	return fmt.Sprintf("\tends %s, %s left", endDate(v), remaining(time.Until(*v.End)))
+}
+
+// endDate returns end date of unused reservations, if it's known
+func endDate(v reservations.Item) string {
+	if v.End == nil {
+		return ""
+	}
+	return v.End.Format("2006-01-02")
+}
+
+// remaining returns remaining term in days, or in months if it's over 90 days
+func remaining(d time.Duration) string {
+	switch n := int(d.Hours() / 24); {
+	case n > 90:
+		return fmt.Sprintf("%d months", n/30)
+	case n == 1:
+		return "1 day"
+	default:
+		return fmt.Sprintf("%d days", n)
+	}
+}
+
+func writeExpiring(w io.Writer, expiring []reservationTerm) {
+	if len(expiring) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Expiring reservations:")
+	for _, v := range expiring {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\tends %s\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy, v.End.Format("2006-01-02"))
+	}
+}
+
+func writeIncoming(w io.Writer, incoming []reservationTerm) {
+	if len(incoming) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Incoming reservations (queued purchases):")
+	for _, v := range incoming {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\tstarts %s\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy, v.Start.Format("2006-01-02"))
+	}
+}
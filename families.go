@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// familyCoverage is point-in-time coverage of instance family by
+// reservations and Savings Plans; size-flexible reservations make family
+// the granularity purchases are planned at
+type familyCoverage struct {
+	Family   string  `json:"family"`
+	Running  int     `json:"running"`
+	OnDemand int     `json:"onDemand"`
+	Coverage float64 `json:"coverage"` // percent of running instances
+}
+
+// coverFamilies sets coverage per instance family of reports in res.
+// Running instances of aggregated reports are counted over all reports in
+// res of the same service and region.
+func (res *result) coverFamilies() {
+	for _, rep := range res.Reports {
+		if rep.inv != nil {
+			rep.Families = familyCoverages(rep, rep.inv.Running)
+		}
+	}
+	for _, rep := range res.Aggregated {
+		running := make(map[reservations.Key]int)
+		for _, r := range res.Reports {
+			if r.Service != rep.Service || r.Region != rep.Region || r.inv == nil {
+				continue
+			}
+			for k, n := range r.inv.Running {
+				running[k] += n
+			}
+		}
+		rep.Families = familyCoverages(rep, running)
+	}
+}
+
+// familyCoverages returns coverage per family of running instances, families
+// with lowest coverage first
+func familyCoverages(rep *report, running map[reservations.Key]int) []familyCoverage {
+	total := make(map[string]int)
+	for k, n := range running {
+		total[reservations.Family(k.Type)] += n
+	}
+	onDemand := make(map[string]int)
+	for _, v := range rep.OnDemandInstances {
+		onDemand[reservations.Family(v.Type)] += v.Count - v.SavingsPlans
+	}
+	out := make([]familyCoverage, 0, len(total))
+	for fam, n := range total {
+		if n == 0 {
+			continue
+		}
+		out = append(out, familyCoverage{
+			Family:   fam,
+			Running:  n,
+			OnDemand: onDemand[fam],
+			Coverage: percent(n-onDemand[fam], n, 1),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Coverage != out[j].Coverage {
+			return out[i].Coverage < out[j].Coverage
+		}
+		return out[i].Family < out[j].Family
+	})
+	return out
+}
+
+func writeFamilyCoverage(w io.Writer, fs []familyCoverage) {
+	if len(fs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Coverage by instance family:")
+	for _, f := range fs {
+		fmt.Fprintf(w, "%s\t%d running\t%g%%\t%d on-demand\n", f.Family, f.Running, f.Coverage, f.OnDemand)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// tag is a single tag key=value pair
+type tag struct{ Key, Value string }
+
+// tagList is a flag.Value holding tags given as repeated key=value flags
+type tagList []tag
+
+func (l *tagList) String() string {
+	var parts []string
+	for _, t := range *l {
+		parts = append(parts, t.Key+"="+t.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *tagList) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid tag %q, must be in key=value form", s)
+	}
+	*l = append(*l, tag{Key: k, Value: v})
+	return nil
+}
+
+// filters returns DescribeInstances filters matching instances having all tag
+// keys of l, with any of the values given for each key
+func (l tagList) filters() []types.Filter {
+	var out []types.Filter
+	byKey := make(map[string]int) // index in out
+	for _, t := range l {
+		i, ok := byKey[t.Key]
+		if !ok {
+			i = len(out)
+			byKey[t.Key] = i
+			out = append(out, types.Filter{Name: aws.String("tag:" + t.Key)})
+		}
+		out[i].Values = append(out[i].Values, t.Value)
+	}
+	return out
+}
+
+// hasAnyTag reports whether tags include any of the tags in l
+func hasAnyTag(tags []types.Tag, l tagList) bool {
+	for _, t := range tags {
+		for _, want := range l {
+			if aws.ToString(t.Key) == want.Key && aws.ToString(t.Value) == want.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// globList is a flag.Value holding comma-separated list of glob patterns, as
+// understood by path.Match
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if _, err := path.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", v, err)
+		}
+		*g = append(*g, v)
+	}
+	return nil
+}
+
+// filterList is a flag.Value holding DescribeInstances filters given as
+// repeated name=value flags; value may be a comma-separated list
+type filterList []types.Filter
+
+func (l *filterList) String() string {
+	var parts []string
+	for _, f := range *l {
+		parts = append(parts, aws.ToString(f.Name)+"="+strings.Join(f.Values, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *filterList) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" || value == "" {
+		return fmt.Errorf("invalid filter %q, must be in name=value form", s)
+	}
+	values := strings.Split(value, ",")
+	for i := range *l {
+		if aws.ToString((*l)[i].Name) == name {
+			(*l)[i].Values = append((*l)[i].Values, values...)
+			return nil
+		}
+	}
+	*l = append(*l, types.Filter{Name: aws.String(name), Values: values})
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// floatReports reconciles reports of different accounts the way consolidated
+// billing applies reservations: AZ-scoped reservations only cover instances of
+// the account they were purchased in, while Region-scoped reservations of all
+// accounts are pooled per service and region and cover instances of any
+// account. It returns one report per service and region. Reports must be
+// created by inspect or inspectService.
+func floatReports(reps []*report) []*report {
+	type region struct{ service, name string }
+	running := make(map[region]*reservations.Inventory)
+	pooled := make(map[region]*reservations.Reservations)
+	zonalUnused := make(map[region][]reservations.Item)
+	var regions []region
+	for _, r := range reps {
+		if r.inv == nil {
+			continue
+		}
+		reg := region{r.Service, r.Region}
+		inv, ok := running[reg]
+		if !ok {
+			inv = reservations.NewInventory()
+			running[reg] = inv
+			pooled[reg] = reservations.NewReservations()
+			regions = append(regions, reg)
+		}
+		// AZ-scoped reservations are applied within account first, what's
+		// left uncovered is covered by pooled Region-scoped ones
+		zonal := reservations.Reconcile(r.inv, &reservations.Reservations{AZ: r.ris.AZ, Terms: r.ris.Terms})
+		for _, v := range zonal.OnDemandInstances {
+			inv.Running[v.Key()] += v.Count
+		}
+		zonalUnused[reg] = append(zonalUnused[reg], zonal.UnusedReservations...)
+		pooled[reg].Merge(&reservations.Reservations{Region: r.ris.Region, Pools: r.ris.Pools, Terms: r.ris.Terms})
+	}
+	out := make([]*report, 0, len(regions))
+	for _, reg := range regions {
+		rep := &report{Service: reg.service, Region: reg.name, Result: *reservations.Reconcile(running[reg], pooled[reg])}
+		rep.Running = 0 // pooled inventory only has instances left uncovered within accounts
+		for _, r := range reps {
+			if r.Service == reg.service && r.Region == reg.name {
+				rep.Running += r.Running
+				rep.Spot = append(rep.Spot, r.Spot...)
+			}
+		}
+		rep.OnDemandInstances = mergeInfos(rep.OnDemandInstances)
+		rep.UnusedReservations = mergeInfos(append(rep.UnusedReservations, zonalUnused[reg]...))
+		rep.Spot = mergeInfos(rep.Spot)
+		out = append(out, rep)
+	}
+	sortReports(out)
+	return out
+}
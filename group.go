@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// groupByFamily is -group-by value collapsing instance sizes into families
+const groupByFamily = "family"
+
+// grouped returns copy of res with rows of reports grouped by family if
+// res.GroupBy is set so, or res itself otherwise. Reports are copied, so that
+// res can be written concurrently.
+func (res *result) grouped() *result {
+	if res.GroupBy != groupByFamily {
+		return res
+	}
+	out := *res
+	out.Reports = groupReports(res.Reports, res.Normalized)
+	out.Aggregated = groupReports(res.Aggregated, res.Normalized)
+	return &out
+}
+
+func groupReports(reps []*report, normalized bool) []*report {
+	if reps == nil {
+		return nil
+	}
+	out := make([]*report, len(reps))
+	for i, rep := range reps {
+		r := *rep
+		r.OnDemandInstances = groupFamilies(rep.OnDemandInstances, normalized)
+		r.UnusedReservations = groupFamilies(rep.UnusedReservations, normalized)
+		r.Spot = groupFamilies(rep.Spot, normalized)
+		out[i] = &r
+	}
+	return out
+}
+
+// groupFamilies collapses sizes of items into families, keeping AZ, platform
+// and tenancy apart. If normalized is set, counts are converted to
+// normalized units; types without known normalization factor are kept as is
+// then. Details specific to instance type are dropped.
+func groupFamilies(items []reservations.Item, normalized bool) []reservations.Item {
+	if items == nil {
+		return nil
+	}
+	out := make([]reservations.Item, 0, len(items))
+	for _, v := range items {
+		if normalized {
+			units := reservations.SizeUnits(v.Type)
+			if units == 0 {
+				out = append(out, v)
+				continue
+			}
+			v.Count *= units
+			v.SavingsPlans *= units
+		}
+		v.Type = reservations.Family(v.Type)
+		v.Utilization, v.Offering, v.OnDemandRate = nil, nil, 0
+		out = append(out, v)
+	}
+	return mergeInfos(out)
+}
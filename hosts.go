@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// dedicatedHost is an allocated Dedicated Host
+type dedicatedHost struct {
+	ID          string `json:"id"`
+	Family      string `json:"family"`
+	Type        string `json:"type,omitempty"` // only set for hosts supporting single instance type
+	AZ          string `json:"az"`
+	Instances   int    `json:"instances"`   // running on the host
+	Utilization int    `json:"utilization"` // percentage of host vCPUs used by instances
+}
+
+// hostReservation is a Dedicated Host Reservation some hosts of which are not
+// allocated
+type hostReservation struct {
+	ID     string    `json:"id"`
+	Family string    `json:"family"`
+	Count  int       `json:"count"`  // hosts reserved
+	Unused int       `json:"unused"` // reserved hosts not allocated
+	End    time.Time `json:"end"`
+}
+
+// fetchDedicatedHosts returns allocated Dedicated Hosts without reservation,
+// and active Dedicated Host Reservations not applied to allocated hosts in
+// full. Hosts are limited to azs, if set.
+func fetchDedicatedHosts(ctx context.Context, svc ec2API, azs commaList) ([]dedicatedHost, []hostReservation, error) {
+	allocated := make(map[string]bool) // host ids
+	var hosts []dedicatedHost
+	paginator := ec2.NewDescribeHostsPaginator(svc, &ec2.DescribeHostsInput{})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, h := range page.Hosts {
+			switch h.State {
+			case types.AllocationStateReleased, types.AllocationStateReleasedPermanentFailure:
+				continue
+			}
+			allocated[aws.ToString(h.HostId)] = true
+			az := aws.ToString(h.AvailabilityZone)
+			if h.HostReservationId != nil || len(azs) > 0 && !azs.has(az) {
+				continue
+			}
+			host := dedicatedHost{
+				ID:        aws.ToString(h.HostId),
+				AZ:        az,
+				Instances: len(h.Instances),
+			}
+			if p := h.HostProperties; p != nil {
+				host.Family, host.Type = aws.ToString(p.InstanceFamily), aws.ToString(p.InstanceType)
+				if total := aws.ToInt32(p.TotalVCpus); total > 0 && h.AvailableCapacity != nil {
+					host.Utilization = int(100 * (total - aws.ToInt32(h.AvailableCapacity.AvailableVCpus)) / total)
+				}
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Family != hosts[j].Family {
+			return hosts[i].Family < hosts[j].Family
+		}
+		return hosts[i].AZ < hosts[j].AZ
+	})
+	var unused []hostReservation
+	rp := ec2.NewDescribeHostReservationsPaginator(svc, &ec2.DescribeHostReservationsInput{
+		Filter: []types.Filter{{
+			Name:   aws.String("state"),
+			Values: []string{string(types.ReservationStateActive)},
+		}},
+	})
+	for rp.HasMorePages() {
+		page, err := rp.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range page.HostReservationSet {
+			hr := hostReservation{
+				ID:     aws.ToString(r.HostReservationId),
+				Family: aws.ToString(r.InstanceFamily),
+				Count:  int(aws.ToInt32(r.Count)),
+				End:    aws.ToTime(r.End),
+			}
+			hr.Unused = hr.Count
+			for _, id := range r.HostIdSet {
+				if allocated[id] {
+					hr.Unused--
+				}
+			}
+			if hr.Unused > 0 {
+				unused = append(unused, hr)
+			}
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool { return unused[i].Family < unused[j].Family })
+	return hosts, unused, nil
+}
+
+func writeDedicatedHosts(w io.Writer, hosts []dedicatedHost, unused []hostReservation) {
+	if len(hosts) > 0 {
+		fmt.Fprintln(w, "Dedicated hosts without reservation:")
+	}
+	for _, h := range hosts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d instances, %d%% used\n", h.Family, h.ID, h.AZ, h.Instances, h.Utilization)
+	}
+	if len(unused) > 0 {
+		fmt.Fprintln(w, "Dedicated host reservations without hosts:")
+	}
+	for _, r := range unused {
+		fmt.Fprintf(w, "%s\t%d of %d\t%s\tuntil %s\n", r.Family, r.Unused, r.Count, r.ID, r.End.Format(time.RFC3339))
+	}
+}
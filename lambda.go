@@ -0,0 +1,22 @@
+//go:build lambda
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func init() {
+	lambdaStart = func(cfg config) {
+		lambda.Start(func(ctx context.Context) error {
+			if err := do(ctx, os.Stdout, cfg); err != nil && !errors.Is(err, errMismatch) {
+				return err
+			}
+			return nil
+		})
+	}
+}
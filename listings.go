@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// fetchListings returns number of instances of reservations listed for sale
+// on Reserved Instance Marketplace and not sold yet, by reservation id
+func fetchListings(ctx context.Context, svc ec2API) (map[string]int, error) {
+	// DescribeReservedInstancesListings is not paginated
+	out, err := svc.DescribeReservedInstancesListings(ctx, &ec2.DescribeReservedInstancesListingsInput{
+		Filters: []types.Filter{{
+			Name:   aws.String("status"),
+			Values: []string{string(types.ListingStatusActive), string(types.ListingStatusPending)},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]int)
+	for _, l := range out.ReservedInstancesListings {
+		for _, c := range l.InstanceCounts {
+			if c.State == types.ListingStateAvailable || c.State == types.ListingStatePending {
+				listed[aws.ToString(l.ReservedInstancesId)] += int(aws.ToInt32(c.InstanceCount))
+			}
+		}
+	}
+	return listed, nil
+}
+
+// listedReservations returns reservations of ris listed for sale
+func listedReservations(ris *reservations.Reservations) []reservationTerm {
+	var out []reservationTerm
+	for _, t := range ris.Listed {
+		out = append(out, newReservationTerm(t))
+	}
+	return out
+}
+
+func writeListed(w io.Writer, listed []reservationTerm) {
+	if len(listed) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Listed for sale on Reserved Instance Marketplace:")
+	for _, v := range listed {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy, v.ID)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/memorydb"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// fetchMemoryDB counts nodes of MemoryDB clusters (primary and replica nodes
+// of every shard) and active reserved nodes. Reserved nodes are Region-scoped
+// and size flexible within node type family, like ElastiCache ones.
+func fetchMemoryDB(ctx context.Context, account string, awsCfg aws.Config, cfg config, prog *progress) (*reservations.Inventory, *reservations.Reservations, error) {
+	svc := memorydb.NewFromConfig(awsCfg)
+	opts := cfg.options()
+	inv := reservations.NewInventory()
+	prog.Printf("fetching MemoryDB clusters in %s", awsCfg.Region)
+	input := &memorydb.DescribeClustersInput{ShowShardDetails: aws.Bool(true)}
+	for {
+		page, err := svc.DescribeClusters(ctx, input)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range page.Clusters {
+			typ := aws.ToString(c.NodeType)
+			if !opts.TypeSelected(typ) {
+				continue
+			}
+			var n int
+			for _, s := range c.Shards {
+				n += int(aws.ToInt32(s.NumberOfNodes))
+			}
+			inv.Running[reservations.Key{Type: typ}] += n
+		}
+		if aws.ToString(page.NextToken) == "" {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	prog.Printf("fetching MemoryDB reserved nodes in %s", awsCfg.Region)
+	ris := reservations.NewReservations()
+	rinput := &memorydb.DescribeReservedNodesInput{}
+	for {
+		page, err := svc.DescribeReservedNodes(ctx, rinput)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range page.ReservedNodes {
+			typ := aws.ToString(r.NodeType)
+			if !opts.Active(aws.ToString(r.State)) || !opts.TypeSelected(typ) {
+				continue
+			}
+			if !opts.StrictTypes && reservations.SizeUnits(typ) > 0 {
+				ris.AddFlexible(typ, "", int(r.NodeCount))
+				continue
+			}
+			ris.Region[reservations.Key{Type: typ}] += int(r.NodeCount)
+		}
+		if aws.ToString(page.NextToken) == "" {
+			break
+		}
+		rinput.NextToken = page.NextToken
+	}
+	return inv, ris, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// pendingModification describes reservation which is in the middle of
+// modification, so its reconciliation may look surprising until modification
+// completes
+type pendingModification struct {
+	ID      string   `json:"id"`      // modification id
+	Source  []string `json:"source"`  // ids of reservations being modified
+	Targets []string `json:"targets"` // human-readable target configurations
+}
+
+// fetchPendingModifications returns reserved instances modifications that are
+// still being processed
+func fetchPendingModifications(ctx context.Context, svc ec2API) ([]pendingModification, error) {
+	var out []pendingModification
+	input := &ec2.DescribeReservedInstancesModificationsInput{
+		Filters: []types.Filter{{
+			Name:   aws.String("status"),
+			Values: []string{"processing"},
+		}},
+	}
+	paginator := ec2.NewDescribeReservedInstancesModificationsPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page.ReservedInstancesModifications {
+			pm := pendingModification{ID: aws.ToString(m.ReservedInstancesModificationId)}
+			for _, id := range m.ReservedInstancesIds {
+				pm.Source = append(pm.Source, aws.ToString(id.ReservedInstancesId))
+			}
+			for _, r := range m.ModificationResults {
+				if t := r.TargetConfiguration; t != nil {
+					pm.Targets = append(pm.Targets, fmt.Sprintf("%s x%d %s",
+						t.InstanceType,
+						aws.ToInt32(t.InstanceCount),
+						targetPlacement(t)))
+				}
+			}
+			out = append(out, pm)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func targetPlacement(t *types.ReservedInstancesConfiguration) string {
+	if az := aws.ToString(t.AvailabilityZone); az != "" {
+		return az
+	}
+	return string(t.Scope)
+}
+
+// writePendingModifications writes informational section on modifications in
+// progress
+func writePendingModifications(w io.Writer, mods []pendingModification) {
+	if len(mods) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Reservations being modified (report may be inaccurate for them):")
+	for _, m := range mods {
+		fmt.Fprintf(w, "%s\t%s\t-> %s\n", m.ID, strings.Join(m.Source, ","), strings.Join(m.Targets, ", "))
+	}
+}
+
+// modificationSuggestion is a suggested ModifyReservedInstances call moving
+// part of unused AZ-scoped reservation to another zone of the region, or
+// changing its scope to Region
+type modificationSuggestion struct {
+	Reservation string `json:"reservation"` // id of reservation to modify
+	Type        string `json:"type"`
+	Platform    string `json:"platform,omitempty"`
+	Tenancy     string `json:"tenancy,omitempty"`
+	Count       int    `json:"count"`             // number of instances to move
+	From        string `json:"from"`              // AZ
+	To          string `json:"to"`                // AZ, or Region for scope change
+	Command     string `json:"command,omitempty"` // aws CLI command, only set with -modify-commands
+}
+
+// suggestMoves matches unused AZ-scoped reservations against on-demand
+// instances of the same type, platform and tenancy in other zones of the
+// region, and suggests moving reservations there. Reservations to move are
+// picked from terms.
+func suggestMoves(onDemand, unused []reservations.Item, terms []reservations.Term) []modificationSuggestion {
+	gaps := make(map[reservations.Key]int)
+	for _, v := range onDemand {
+		if v.AZ != "" {
+			gaps[v.Key()] += v.Count
+		}
+	}
+	moved := make(map[string]int) // instances moved by reservation id
+	var out []modificationSuggestion
+	for _, u := range unused {
+		if u.AZ == "" {
+			continue
+		}
+		surplus := u.Count
+		for _, v := range onDemand {
+			k := v.Key()
+			if surplus == 0 || v.AZ == "" || v.AZ == u.AZ || gaps[k] == 0 ||
+				v.Type != u.Type || v.Platform != u.Platform || v.Tenancy != u.Tenancy {
+				continue
+			}
+			n := surplus
+			if n > gaps[k] {
+				n = gaps[k]
+			}
+			for _, t := range terms {
+				if n == 0 {
+					break
+				}
+				left := t.Count - moved[t.ID]
+				if t.Key != u.Key() || left <= 0 {
+					continue
+				}
+				if left > n {
+					left = n
+				}
+				moved[t.ID] += left
+				n -= left
+				surplus -= left
+				gaps[k] -= left
+				out = append(out, modificationSuggestion{Reservation: t.ID, Type: u.Type, Platform: u.Platform,
+					Tenancy: u.Tenancy, Count: left, From: u.AZ, To: v.AZ})
+			}
+		}
+	}
+	return out
+}
+
+// regionScope is modificationSuggestion.To for scope change
+const regionScope = "Region"
+
+// suggestRegional suggests changing scope to Region for unused AZ-scoped
+// reservations left after moves, if instances they could cover run uncovered
+// in other zones: instances of the same type, or for size-flexible
+// reservations instances of the same family. Region scope makes such
+// reservations follow instances across zones.
+func suggestRegional(onDemand, unused []reservations.Item, terms []reservations.Term, moves []modificationSuggestion) []modificationSuggestion {
+	moved := make(map[string]int) // instances moved by reservation id
+	gaps := make(map[reservations.Key]int)
+	for _, v := range onDemand {
+		if v.AZ != "" {
+			gaps[v.Key()] += v.Count
+		}
+	}
+	movedFrom := make(map[reservations.Key]int)
+	for _, m := range moves {
+		moved[m.Reservation] += m.Count
+		movedFrom[reservations.Key{Type: m.Type, AZ: m.From, Platform: m.Platform, Tenancy: m.Tenancy}] += m.Count
+		gaps[reservations.Key{Type: m.Type, AZ: m.To, Platform: m.Platform, Tenancy: m.Tenancy}] -= m.Count
+	}
+	var out []modificationSuggestion
+	for _, u := range unused {
+		if u.AZ == "" {
+			continue
+		}
+		units := reservations.SizeUnits(u.Type)
+		// Region-scoped reservation would be size-flexible
+		flexible := units > 0 && u.Tenancy == "" && (u.Platform == "" || u.Platform == reservations.LinuxPlatform)
+		var demand int // instances, or size units for flexible reservations
+		for _, v := range onDemand {
+			k := v.Key()
+			if v.AZ == "" || v.AZ == u.AZ || gaps[k] <= 0 || v.Platform != u.Platform || v.Tenancy != u.Tenancy {
+				continue
+			}
+			switch {
+			case flexible && reservations.Family(v.Type) == reservations.Family(u.Type):
+				demand += gaps[k] * reservations.SizeUnits(v.Type)
+			case !flexible && v.Type == u.Type:
+				demand += gaps[k]
+			}
+		}
+		n := demand
+		if flexible {
+			n = (demand + units - 1) / units
+		}
+		if surplus := u.Count - movedFrom[u.Key()]; n > surplus {
+			n = surplus
+		}
+		for _, t := range terms {
+			if n <= 0 {
+				break
+			}
+			left := t.Count - moved[t.ID]
+			if t.Key != u.Key() || left <= 0 {
+				continue
+			}
+			if left > n {
+				left = n
+			}
+			moved[t.ID] += left
+			n -= left
+			out = append(out, modificationSuggestion{Reservation: t.ID, Type: u.Type, Platform: u.Platform,
+				Tenancy: u.Tenancy, Count: left, From: u.AZ, To: regionScope})
+		}
+	}
+	return out
+}
+
+// modifyCommands sets Command of suggestions to aws CLI command doing the
+// modification. All suggestions for the same reservation are done by a single
+// command, and get the same Command. Instances of the reservation that are not
+// modified are kept in the original zone, as target configurations must add
+// up to reservation instance count.
+func modifyCommands(region string, sugs []modificationSuggestion, terms []reservations.Term) {
+	rest := make(map[string]int) // instances not modified by reservation id
+	for _, t := range terms {
+		rest[t.ID] += t.Count
+	}
+	targets := make(map[string][]string) // by reservation id
+	var ids []string
+	for _, s := range sugs {
+		if _, ok := targets[s.Reservation]; !ok {
+			ids = append(ids, s.Reservation)
+		}
+		targets[s.Reservation] = append(targets[s.Reservation], targetConfiguration(s.To, s.Count))
+		rest[s.Reservation] -= s.Count
+	}
+	commands := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if n := rest[id]; n > 0 {
+			for _, s := range sugs {
+				if s.Reservation == id {
+					targets[id] = append(targets[id], targetConfiguration(s.From, n))
+					break
+				}
+			}
+		}
+		commands[id] = fmt.Sprintf("aws ec2 modify-reserved-instances --region %s --reserved-instances-ids %s --target-configurations %s",
+			region, id, strings.Join(targets[id], " "))
+	}
+	for i := range sugs {
+		sugs[i].Command = commands[sugs[i].Reservation]
+	}
+}
+
+// targetConfiguration returns shell-quoted aws CLI target configuration of n
+// instances in AZ, or Region-scoped ones
+func targetConfiguration(az string, n int) string {
+	if az == regionScope {
+		return fmt.Sprintf("'InstanceCount=%d,Scope=Region'", n)
+	}
+	return fmt.Sprintf("'AvailabilityZone=%s,InstanceCount=%d,Scope=Availability Zone'", az, n)
+}
+
+func writeModificationSuggestions(w io.Writer, sugs []modificationSuggestion) {
+	if len(sugs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Suggested reservation modifications:")
+	for i, s := range sugs {
+		fmt.Fprintf(w, "%s\t%d\t%s -> %s\t%s\t%s\t%s\n", s.Type, s.Count, s.From, s.To, s.Platform, s.Tenancy, s.Reservation)
+		// suggestions for the same reservation share the command
+		if s.Command != "" && (i == len(sugs)-1 || sugs[i+1].Command != s.Command) {
+			fmt.Fprintf(w, "\t%s\n", s.Command)
+		}
+	}
+}
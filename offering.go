@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// offeringClasses is the number of standard and convertible reservations of
+// instance type. Unused convertible reservations can be exchanged, while
+// unused standard ones can only be modified or sold.
+type offeringClasses struct {
+	Type        string `json:"type"`
+	Standard    int    `json:"standard"`
+	Convertible int    `json:"convertible"`
+}
+
+// countOfferingClasses returns offering classes of reservations per instance
+// type. It returns nil if there are no convertible reservations, since
+// breakdown is not informative then.
+func countOfferingClasses(terms []reservations.Term) []offeringClasses {
+	idx := make(map[string]int) // index in out by type
+	var out []offeringClasses
+	var convertible bool
+	for _, t := range terms {
+		if t.Count <= 0 {
+			continue
+		}
+		i, ok := idx[t.Key.Type]
+		if !ok {
+			i = len(out)
+			idx[t.Key.Type] = i
+			out = append(out, offeringClasses{Type: t.Key.Type})
+		}
+		if t.Convertible {
+			out[i].Convertible += t.Count
+			convertible = true
+		} else {
+			out[i].Standard += t.Count
+		}
+	}
+	if !convertible {
+		return nil
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+	return out
+}
+
+func writeOfferingClasses(w io.Writer, classes []offeringClasses) {
+	if len(classes) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Reservations by offering class (standard, convertible):")
+	for _, c := range classes {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", c.Type, c.Standard, c.Convertible)
+	}
+}
+
+// offeringNote returns note on payment terms of unused reservations, if
+// they're known
+func offeringNote(v reservations.Item) string {
+	o := v.Offering
+	if o == nil {
+		return ""
+	}
+	return fmt.Sprintf("\t%s, %s upfront, %s/hour", o.Type, money(o.FixedPrice, o.Currency), money(o.Hourly, o.Currency))
+}
+
+// money formats amount in currency, i.e. $1.5 or 1.5 EUR
+func money(amount float64, currency string) string {
+	if currency == "" || currency == "USD" {
+		return "$" + strconv.FormatFloat(amount, 'f', -1, 32)
+	}
+	return strconv.FormatFloat(amount, 'f', -1, 32) + " " + currency
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fileEC2 is ec2API serving data exported with AWS CLI, i.e.
+//
+//	aws ec2 describe-instances > inventory.json
+//	aws ec2 describe-reserved-instances > ris.json
+//
+// Since API filters are normally applied by AWS, fileEC2 applies the ones
+// this program sets itself; other -filter ones are rejected.
+type fileEC2 struct {
+	instances    string // file with DescribeInstances output
+	reservations string // file with DescribeReservedInstances output
+}
+
+// readJSON decodes JSON file into v
+func readJSON(name string, v interface{}) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (f fileEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	var out ec2.DescribeInstancesOutput
+	if err := readJSON(f.instances, &out); err != nil {
+		return nil, err
+	}
+	out.NextToken = nil
+	ids := make(map[string]bool, len(params.InstanceIds))
+	for _, id := range params.InstanceIds {
+		ids[id] = true
+	}
+	for i := range out.Reservations {
+		r := &out.Reservations[i]
+		instances := r.Instances[:0]
+		for _, inst := range r.Instances {
+			if len(ids) > 0 && !ids[aws.ToString(inst.InstanceId)] {
+				continue
+			}
+			ok, err := matchInstanceFilters(&inst, params.Filters)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				instances = append(instances, inst)
+			}
+		}
+		r.Instances = instances
+	}
+	return &out, nil
+}
+
+// matchInstanceFilters reports whether instance matches all filters
+func matchInstanceFilters(inst *types.Instance, filters []types.Filter) (bool, error) {
+	for _, f := range filters {
+		name := aws.ToString(f.Name)
+		var value string
+		switch {
+		case name == "instance-state-name":
+			if inst.State != nil {
+				value = string(inst.State.Name)
+			}
+		case name == "availability-zone":
+			if inst.Placement != nil {
+				value = aws.ToString(inst.Placement.AvailabilityZone)
+			}
+		case strings.HasPrefix(name, "tag:"):
+			for _, t := range inst.Tags {
+				if aws.ToString(t.Key) == strings.TrimPrefix(name, "tag:") {
+					value = aws.ToString(t.Value)
+				}
+			}
+		default:
+			return false, fmt.Errorf("filter %q is not supported with -instances-file", name)
+		}
+		if !commaList(f.Values).has(value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (f fileEC2) DescribeReservedInstances(ctx context.Context, params *ec2.DescribeReservedInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesOutput, error) {
+	var out ec2.DescribeReservedInstancesOutput
+	if f.reservations == "" {
+		return &out, nil
+	}
+	if err := readJSON(f.reservations, &out); err != nil {
+		return nil, err
+	}
+	var states []string
+	for _, flt := range params.Filters {
+		if aws.ToString(flt.Name) == "state" {
+			states = flt.Values
+		}
+	}
+	ris := out.ReservedInstances[:0]
+	for _, r := range out.ReservedInstances {
+		if len(states) == 0 || commaList(states).has(string(r.State)) {
+			ris = append(ris, r)
+		}
+	}
+	out.ReservedInstances = ris
+	return &out, nil
+}
+
+// DescribeCapacityReservations returns no capacity reservations, they're not
+// part of exported data
+func (f fileEC2) DescribeCapacityReservations(ctx context.Context, params *ec2.DescribeCapacityReservationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeCapacityReservationsOutput, error) {
+	return &ec2.DescribeCapacityReservationsOutput{}, nil
+}
+
+// DescribeCapacityReservationFleets returns no fleets, they're not part of
+// exported data
+func (f fileEC2) DescribeCapacityReservationFleets(ctx context.Context, params *ec2.DescribeCapacityReservationFleetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeCapacityReservationFleetsOutput, error) {
+	return &ec2.DescribeCapacityReservationFleetsOutput{}, nil
+}
+
+// DescribeHosts returns no hosts, they're not part of exported data
+func (f fileEC2) DescribeHosts(ctx context.Context, params *ec2.DescribeHostsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeHostsOutput, error) {
+	return &ec2.DescribeHostsOutput{}, nil
+}
+
+// DescribeHostReservations returns no host reservations, they're not part of
+// exported data
+func (f fileEC2) DescribeHostReservations(ctx context.Context, params *ec2.DescribeHostReservationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeHostReservationsOutput, error) {
+	return &ec2.DescribeHostReservationsOutput{}, nil
+}
+
+// DescribeReservedInstancesListings returns no listings, they're not part of
+// exported data
+func (f fileEC2) DescribeReservedInstancesListings(ctx context.Context, params *ec2.DescribeReservedInstancesListingsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesListingsOutput, error) {
+	return &ec2.DescribeReservedInstancesListingsOutput{}, nil
+}
+
+// DescribeReservedInstancesModifications returns no modifications, they're
+// not part of exported data
+func (f fileEC2) DescribeReservedInstancesModifications(ctx context.Context, params *ec2.DescribeReservedInstancesModificationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesModificationsOutput, error) {
+	return &ec2.DescribeReservedInstancesModificationsOutput{}, nil
+}
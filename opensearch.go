@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/opensearch"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// describeDomainsMax is the max number of domains DescribeDomains accepts
+const describeDomainsMax = 5
+
+// fetchOpenSearch counts data and dedicated master nodes of OpenSearch Service
+// domains and active reserved instances. Reserved instances are Region-scoped
+// and only cover nodes of the same instance type. UltraWarm nodes are not
+// counted.
+func fetchOpenSearch(ctx context.Context, account string, awsCfg aws.Config, cfg config, prog *progress) (*reservations.Inventory, *reservations.Reservations, error) {
+	svc := opensearch.NewFromConfig(awsCfg)
+	opts := cfg.options()
+	inv := reservations.NewInventory()
+	prog.Printf("fetching OpenSearch domains in %s", awsCfg.Region)
+	list, err := svc.ListDomainNames(ctx, &opensearch.ListDomainNamesInput{})
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, d := range list.DomainNames {
+		names = append(names, aws.ToString(d.DomainName))
+	}
+	count := func(typ string, n int32) {
+		if typ != "" && opts.TypeSelected(typ) {
+			inv.Running[reservations.Key{Type: typ}] += int(n)
+		}
+	}
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > describeDomainsMax {
+			batch = batch[:describeDomainsMax]
+		}
+		names = names[len(batch):]
+		out, err := svc.DescribeDomains(ctx, &opensearch.DescribeDomainsInput{DomainNames: batch})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range out.DomainStatusList {
+			c := d.ClusterConfig
+			if aws.ToBool(d.Deleted) || c == nil {
+				continue
+			}
+			count(string(c.InstanceType), aws.ToInt32(c.InstanceCount))
+			if aws.ToBool(c.DedicatedMasterEnabled) {
+				count(string(c.DedicatedMasterType), aws.ToInt32(c.DedicatedMasterCount))
+			}
+		}
+	}
+	prog.Printf("fetching OpenSearch reserved instances in %s", awsCfg.Region)
+	ris := reservations.NewReservations()
+	p := opensearch.NewDescribeReservedInstancesPaginator(svc, &opensearch.DescribeReservedInstancesInput{})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range page.ReservedInstances {
+			typ := string(r.InstanceType)
+			if !opts.Active(aws.ToString(r.State)) || !opts.TypeSelected(typ) {
+				continue
+			}
+			ris.Region[reservations.Key{Type: typ}] += int(r.InstanceCount)
+		}
+	}
+	return inv, ris, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// result is the complete outcome of a run
+type result struct {
+	Time       time.Time `json:"time"`
+	Summary    *summary  `json:"summary"`              // totals of reports
+	Reports    []*report `json:"reports"`              // per account and region
+	Aggregated []*report `json:"aggregated,omitempty"` // per region, for all accounts
+
+	GroupBy    string `json:"groupBy,omitempty"`         // rows are grouped by when written, see -group-by
+	Normalized bool   `json:"normalizedUnits,omitempty"` // counts of grouped rows are in normalized units
+
+	SavingsPlans *savingsPlansUsage `json:"savingsPlans,omitempty"` // only set with -savings-plans
+	Cost         *costEstimate      `json:"cost,omitempty"`         // total of reports, only set with -costs
+
+	multiAccount bool
+	multiRegion  bool
+	multiService bool
+	float        bool
+}
+
+// writeFormat writes result in given format
+func writeFormat(w io.Writer, format string, res *result) error {
+	res = res.grouped()
+	switch format {
+	case "json":
+		return writeJSON(w, res)
+	case "csv":
+		return writeCSV(w, res)
+	case "markdown":
+		return writeMarkdown(w, res)
+	case "html":
+		return writeHTML(w, res)
+	default:
+		return writeText(w, res)
+	}
+}
+
+// billed returns reports reflecting how reservations are billed: aggregated
+// ones in consolidated billing view, otherwise per account ones
+func (res *result) billed() []*report {
+	if res.float && res.Aggregated != nil {
+		return res.Aggregated
+	}
+	return res.Reports
+}
+
+// exceeds reports whether any report has more on-demand instances or unused
+// reservations than tolerated. In consolidated billing view only aggregated
+// reports count.
+func (res *result) exceeds(maxUncovered, maxUnused int) bool {
+	for _, rep := range res.billed() {
+		if rep.exceeds(maxUncovered, maxUnused) {
+			return true
+		}
+	}
+	return false
+}
+
+// summary is the headline of result
+type summary struct {
+	Running      int     `json:"running"`
+	Covered      int     `json:"covered"`  // by reservations or Savings Plans
+	Coverage     float64 `json:"coverage"` // percentage of running instances covered
+	OnDemand     int     `json:"onDemand"`
+	SavingsPlans int     `json:"savingsPlans,omitempty"` // estimated, only set with -savings-plans
+	Unused       int     `json:"unused"`
+}
+
+// summarize returns totals of billed reports
+func (res *result) summarize() *summary {
+	s := &summary{}
+	for _, rep := range res.billed() {
+		s.Running += rep.Running
+		s.OnDemand += rep.Uncovered()
+		s.SavingsPlans += rep.savingsPlansCovered()
+		s.Unused += rep.Unused()
+	}
+	s.OnDemand -= s.SavingsPlans
+	s.Covered = s.Running - s.OnDemand
+	s.Coverage = percent(s.Covered, s.Running, 1)
+	return s
+}
+
+func (s *summary) String() string {
+	out := fmt.Sprintf("%d running, %d covered (%g%%), %d on-demand, %d unused RIs", s.Running, s.Covered, s.Coverage, s.OnDemand, s.Unused)
+	if s.SavingsPlans > 0 {
+		out += fmt.Sprintf(" (~%d covered by Savings Plans)", s.SavingsPlans)
+	}
+	return out
+}
+
+// newService reports whether reps[i] is the first report of its service in
+// multi-service result
+func (res *result) newService(reps []*report, i int) bool {
+	return res.multiService && (i == 0 || reps[i].Service != reps[i-1].Service)
+}
+
+// writeJSON writes result as indented JSON. Reports are encoded and written
+// one by one, so that encoded output of many accounts and regions is never
+// held in memory as a whole; output is the same json.Encoder would write.
+func writeJSON(w io.Writer, res *result) error {
+	if len(res.Reports) == 0 {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	// encode everything but reports, then write reports in place of the
+	// empty list
+	head := *res
+	head.Reports = []*report{}
+	b, err := json.MarshalIndent(&head, "", "  ")
+	if err != nil {
+		return err
+	}
+	const placeholder = `"reports": []`
+	i := bytes.Index(b, []byte(placeholder))
+	if i < 0 {
+		return errors.New("no reports in encoded result")
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write(b[:i+len(placeholder)-1])
+	for j, rep := range res.Reports {
+		if j > 0 {
+			bw.WriteByte(',')
+		}
+		bw.WriteString("\n    ")
+		rb, err := json.MarshalIndent(rep, "    ", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(rb); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("\n  ]")
+	bw.Write(b[i+len(placeholder):])
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// writeCSV writes reports as a flat table with a header, one row per
+// instance type and AZ. Multi-service result has service column first.
+func writeCSV(w io.Writer, res *result) error {
+	cw := csv.NewWriter(w)
+	write := func(rec ...string) {
+		if !res.multiService {
+			rec = rec[1:] // no service column
+		}
+		cw.Write(rec)
+	}
+	write("service", "account", "region", "category", "type", "az", "platform", "tenancy", "count")
+	for _, rep := range res.Reports {
+		for _, v := range rep.OnDemandInstances {
+			write(rep.Service, rep.Account, rep.Region, "uncovered", v.Type, v.AZ, v.Platform, v.Tenancy, strconv.Itoa(v.Count))
+		}
+		for _, v := range rep.UnusedReservations {
+			write(rep.Service, rep.Account, rep.Region, "unused", v.Type, v.AZ, v.Platform, v.Tenancy, strconv.Itoa(v.Count))
+		}
+		for _, v := range rep.Spot {
+			write(rep.Service, rep.Account, rep.Region, "spot", v.Type, v.AZ, v.Platform, v.Tenancy, strconv.Itoa(v.Count))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var htmlTemplate = template.Must(template.New("html").Funcs(template.FuncMap{
+	"resource": (*report).resource,
+	"endDate":  endDate,
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>EC2 reservations</title>
+<style>body{font-family:sans-serif}table{border-collapse:collapse;margin-bottom:1em}
+td,th{border:1px solid #ccc;padding:.2em .5em}td.n{text-align:right}</style>
+</head><body>
+<p>Generated at {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+{{with .Summary}}<p><strong>{{.}}</strong></p>{{end}}
+{{range .Reports}}{{template "report" .}}{{end}}
+{{with .Aggregated}}<h2>All accounts</h2>{{range .}}{{template "report" .}}{{end}}{{end}}
+</body></html>
+{{define "report"}}<h3>{{with .Service}}Service {{.}}, {{end}}{{with .Account}}Account {{.}}, {{end}}Region {{.Region}}</h3>
+{{with .OnDemandInstances}}<table><caption>On-demand {{resource $}}</caption>
+<tr><th>Type</th><th>Count</th><th>AZ</th><th>Platform</th><th>Tenancy</th></tr>
+{{range .}}<tr><td>{{.Type}}</td><td class="n">{{.Count}}</td><td>{{.AZ}}</td><td>{{.Platform}}</td><td>{{.Tenancy}}</td></tr>
+{{end}}</table>{{end}}
+{{with .UnusedReservations}}<table><caption>Unused reservations</caption>
+<tr><th>Type</th><th>Count</th><th>AZ</th><th>Platform</th><th>Tenancy</th><th>Ends</th></tr>
+{{range .}}<tr><td>{{.Type}}</td><td class="n">{{.Count}}</td><td>{{.AZ}}</td><td>{{.Platform}}</td><td>{{.Tenancy}}</td><td>{{endDate .}}</td></tr>
+{{end}}</table>{{end}}
+{{with .Spot}}<table><caption>Spot instances</caption>
+<tr><th>Type</th><th>Count</th><th>AZ</th></tr>
+{{range .}}<tr><td>{{.Type}}</td><td class="n">{{.Count}}</td><td>{{.AZ}}</td></tr>
+{{end}}</table>{{end}}
+{{if not (or .OnDemandInstances .UnusedReservations)}}<p>All instances are covered, no unused reservations.</p>{{end}}
+{{end}}`))
+
+// writeHTML writes reports as standalone HTML page
+func writeHTML(w io.Writer, res *result) error {
+	return htmlTemplate.Execute(w, res)
+}
+
+// writeMarkdown writes reports as GitHub-flavored markdown tables
+func writeMarkdown(w io.Writer, res *result) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "**%s**\n\n", res.Summary)
+	for i, rep := range res.Reports {
+		newService := res.newService(res.Reports, i)
+		if newService {
+			fmt.Fprintf(bw, "# Service %s\n\n", rep.Service)
+		}
+		if res.multiAccount && (newService || i == 0 || rep.Account != res.Reports[i-1].Account) {
+			fmt.Fprintf(bw, "## Account %s\n\n", rep.Account)
+		}
+		if res.multiRegion {
+			fmt.Fprintf(bw, "### Region %s\n\n", rep.Region)
+		}
+		writeMarkdownReport(bw, rep)
+	}
+	if res.multiAccount {
+		if res.float {
+			fmt.Fprint(bw, "## All accounts, regional reservations shared across accounts\n\n")
+		} else {
+			fmt.Fprint(bw, "## All accounts\n\n")
+		}
+		for i, rep := range res.Aggregated {
+			if res.newService(res.Aggregated, i) {
+				fmt.Fprintf(bw, "### Service %s\n\n", rep.Service)
+			}
+			if res.multiRegion {
+				fmt.Fprintf(bw, "### Region %s\n\n", rep.Region)
+			}
+			writeMarkdownReport(bw, rep)
+		}
+	}
+	return bw.Flush()
+}
+
+func writeMarkdownReport(w io.Writer, rep *report) {
+	if len(rep.OnDemandInstances) > 0 {
+		fmt.Fprintf(w, "**On-demand %s**\n\n| Type | Count | AZ | Platform | Tenancy |\n|---|--:|---|---|---|\n", rep.resource())
+		for _, v := range rep.OnDemandInstances {
+			fmt.Fprintf(w, "| %s | %d | %s | %s | %s |\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy)
+		}
+		fmt.Fprintln(w)
+	}
+	if len(rep.UnusedReservations) > 0 {
+		fmt.Fprint(w, "**Unused reservations**\n\n| Type | Count | AZ | Platform | Tenancy | Ends |\n|---|--:|---|---|---|---|\n")
+		for _, v := range rep.UnusedReservations {
+			fmt.Fprintf(w, "| %s | %d | %s | %s | %s | %s |\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy, endDate(v))
+		}
+		fmt.Fprintln(w)
+	}
+	if len(rep.Spot) > 0 {
+		fmt.Fprint(w, "**Spot instances**\n\n| Type | Count | AZ |\n|---|--:|---|\n")
+		for _, v := range rep.Spot {
+			fmt.Fprintf(w, "| %s | %d | %s |\n", v.Type, v.Count, v.AZ)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func writeText(w io.Writer, res *result) error {
+	fmt.Fprintln(w, res.Summary)
+	if res.GroupBy == groupByFamily {
+		note := "Rows grouped by " + res.GroupBy
+		if res.Normalized {
+			note += ", counts in normalized units"
+		}
+		fmt.Fprintln(w, note)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	for i, rep := range res.Reports {
+		newService := res.newService(res.Reports, i)
+		if newService {
+			fmt.Fprintf(tw, "Service %s:\n", rep.Service)
+		}
+		if res.multiAccount && (newService || i == 0 || rep.Account != res.Reports[i-1].Account) {
+			fmt.Fprintf(tw, "Account %s:\n", rep.Account)
+		}
+		if res.multiRegion {
+			fmt.Fprintf(tw, "Region %s:\n", rep.Region)
+		}
+		writeReport(tw, rep)
+	}
+	if res.multiAccount {
+		if res.float {
+			fmt.Fprintln(tw, "All accounts, regional reservations shared across accounts:")
+		} else {
+			fmt.Fprintln(tw, "All accounts:")
+		}
+		for i, rep := range res.Aggregated {
+			if res.newService(res.Aggregated, i) {
+				fmt.Fprintf(tw, "Service %s:\n", rep.Service)
+			}
+			if res.multiRegion {
+				fmt.Fprintf(tw, "Region %s:\n", rep.Region)
+			}
+			writeReport(tw, rep)
+		}
+	}
+	writeSavingsPlans(tw, res.SavingsPlans)
+	writeCost(tw, "Total estimated monthly cost", res.Cost)
+	return tw.Flush()
+}
+
+// writeReport writes report in human-readable form
+func writeReport(tw io.Writer, rep *report) {
+	if len(rep.OnDemandInstances) > 0 {
+		fmt.Fprintf(tw, "On-demand %s:\n", rep.resource())
+	}
+	for _, v := range rep.OnDemandInstances {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s%s%s\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy, rateNote(v, rep.Cost), savingsPlansNote(v))
+	}
+	if len(rep.UnusedReservations) > 0 {
+		fmt.Fprintln(tw, "Unused reservations:")
+	}
+	for _, v := range rep.UnusedReservations {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s%s%s%s\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy, endNote(v), offeringNote(v), utilizationNote(v))
+	}
+	if len(rep.Spot) > 0 {
+		fmt.Fprintln(tw, "Spot instances:")
+	}
+	for _, v := range rep.Spot {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", v.Type, v.Count, v.AZ)
+	}
+	writeFamilyCoverage(tw, rep.Families)
+	writeByTag(tw, rep.TagKey, rep.ByTag, costCurrency(rep.Cost))
+	writeASGs(tw, rep.ASGs, rep.ASGShortfalls, costCurrency(rep.Cost))
+	writeNodeGroups(tw, rep.NodeGroups, costCurrency(rep.Cost))
+	writeOfferingClasses(tw, rep.OfferingClasses)
+	writeExpiring(tw, rep.Expiring)
+	writeIncoming(tw, rep.Incoming)
+	writeListed(tw, rep.Listed)
+	writeCapacityReservations(tw, rep.CapacityReservations)
+	writeCapacityBlocks(tw, rep.CapacityBlocks)
+	writeCapacityFleets(tw, rep.CapacityFleets)
+	writeDedicatedHosts(tw, rep.DedicatedHosts, rep.UnusedHostReservations)
+	writeCoverage(tw, rep.Coverage)
+	writePendingModifications(tw, rep.Modifications)
+	writeExchangeSuggestions(tw, rep.Exchanges)
+	writeModificationSuggestions(tw, rep.Suggested)
+	writeCost(tw, "Estimated monthly cost", rep.Cost)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	for _, dir := range []string{"testdata/replay", "testdata/float"} {
+		res, err := collect(context.Background(), parseConfig(t, "-replay", dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range []*result{res, {Time: res.Time}} {
+			var got, want bytes.Buffer
+			if err := writeJSON(&got, res); err != nil {
+				t.Fatal(err)
+			}
+			enc := json.NewEncoder(&want)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(res); err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != want.String() {
+				t.Errorf("%s: got\n%s\nwant\n%s", dir, got.String(), want.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/pricing"
+	"github.com/aws/aws-sdk-go-v2/service/pricing/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// pricingRegions maps currencies Price List API publishes rates in to
+// regions it's served from in that currency: USD for commercial regions from
+// us-east-1, CNY for China regions from China partition endpoint
+var pricingRegions = map[string]string{
+	"USD": "us-east-1",
+	"CNY": "cn-northwest-1",
+}
+
+// hoursPerMonth is the number of hours AWS bills monthly charges for
+const hoursPerMonth = 730
+
+// priceCacheTTL is how long on-demand rates are kept in price cache file
+const priceCacheTTL = 7 * 24 * time.Hour
+
+// pricingPlatforms maps platforms to Price List operatingSystem and
+// preInstalledSw attributes
+var pricingPlatforms = map[string][2]string{
+	"":                                   {"Linux", "NA"}, // -ignore-platform
+	reservations.LinuxPlatform:           {"Linux", "NA"},
+	"Red Hat Enterprise Linux":           {"RHEL", "NA"},
+	"Red Hat Enterprise Linux with HA":   {"Red Hat Enterprise Linux with HA", "NA"},
+	"SUSE Linux":                         {"SUSE", "NA"},
+	"Ubuntu Pro":                         {"Ubuntu Pro", "NA"},
+	"Windows":                            {"Windows", "NA"},
+	"Windows with SQL Server Standard":   {"Windows", "SQL Std"},
+	"Windows with SQL Server Web":        {"Windows", "SQL Web"},
+	"Windows with SQL Server Enterprise": {"Windows", "SQL Ent"},
+	"Linux with SQL Server Standard":     {"Linux", "SQL Std"},
+	"Linux with SQL Server Web":          {"Linux", "SQL Web"},
+	"Linux with SQL Server Enterprise":   {"Linux", "SQL Ent"},
+}
+
+// pricingTenancies maps tenancies to Price List tenancy attribute. Instances
+// on dedicated hosts are billed per host, so they have no on-demand rate.
+var pricingTenancies = map[string]string{
+	"":          "Shared",
+	"dedicated": "Dedicated",
+}
+
+// defaultPriceCache returns default path of price cache file, or empty
+// string if there's no user cache directory
+func defaultPriceCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ec2-reservations", "on-demand-rates.json")
+}
+
+// cachedRate is on-demand rate saved in price cache file
+type cachedRate struct {
+	Rate    float64   `json:"rate"` // zero if rate is not known
+	Fetched time.Time `json:"fetched"`
+}
+
+// onDemandRates fetches hourly on-demand rates of EC2 instances in given
+// currency from Price List API, remembering ones already fetched. If file is
+// set, rates are loaded from and saved to it.
+type onDemandRates struct {
+	svc      pricing.GetProductsAPIClient
+	currency string
+	file     string
+	rates    map[string]cachedRate // keyed by rateKey
+	dirty    bool
+}
+
+func newOnDemandRates(awsCfg aws.Config, currency, file string) (*onDemandRates, error) {
+	r := &onDemandRates{
+		svc:      pricing.NewFromConfig(awsCfg, func(o *pricing.Options) { o.Region = pricingRegions[currency] }),
+		currency: currency,
+		file:     file,
+		rates:    make(map[string]cachedRate),
+	}
+	if file == "" {
+		return r, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &r.rates); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for k, v := range r.rates {
+		if time.Since(v.Fetched) > priceCacheTTL {
+			delete(r.rates, k)
+		}
+	}
+	return r, nil
+}
+
+// chinaRegion reports whether region is in China partition, credentials of
+// which are not valid in other partitions
+func chinaRegion(region string) bool {
+	return strings.HasPrefix(region, "cn-")
+}
+
+// save writes rates to price cache file, if it's set and there are new rates
+func (r *onDemandRates) save() error {
+	if r.file == "" || !r.dirty {
+		return nil
+	}
+	b, err := json.MarshalIndent(r.rates, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.file), 0o755); err != nil {
+		return err
+	}
+	tmp := r.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.file)
+}
+
+// rateKey returns key on-demand rate of instances with key k in region is
+// cached under
+func rateKey(currency, region string, k reservations.Key) string {
+	return currency + "/" + region + "/" + k.Type + "/" + k.Platform + "/" + k.Tenancy
+}
+
+// rate returns hourly on-demand rate of instances with key k in region, or
+// zero if it's not known
+func (r *onDemandRates) rate(ctx context.Context, region string, k reservations.Key) (float64, error) {
+	rk := rateKey(r.currency, region, k)
+	if v, ok := r.rates[rk]; ok {
+		return v.Rate, nil
+	}
+	rate, err := r.fetch(ctx, region, k)
+	if err != nil {
+		return 0, err
+	}
+	r.rates[rk] = cachedRate{Rate: rate, Fetched: time.Now().UTC()}
+	r.dirty = true
+	return rate, nil
+}
+
+// fetch gets hourly on-demand rate from Price List API
+func (r *onDemandRates) fetch(ctx context.Context, region string, k reservations.Key) (float64, error) {
+	platform, ok := pricingPlatforms[k.Platform]
+	tenancy, ok2 := pricingTenancies[k.Tenancy]
+	if !ok || !ok2 {
+		return 0, nil
+	}
+	var filters []types.Filter
+	for _, f := range [][2]string{
+		{"regionCode", region},
+		{"instanceType", k.Type},
+		{"operatingSystem", platform[0]},
+		{"preInstalledSw", platform[1]},
+		{"tenancy", tenancy},
+		{"capacitystatus", "Used"},
+		{"licenseModel", "No License required"},
+	} {
+		filters = append(filters, types.Filter{Type: types.FilterTypeTermMatch, Field: aws.String(f[0]), Value: aws.String(f[1])})
+	}
+	paginator := pricing.NewGetProductsPaginator(r.svc, &pricing.GetProductsInput{
+		ServiceCode:   aws.String("AmazonEC2"),
+		FormatVersion: aws.String("aws_v1"),
+		Filters:       filters,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, s := range page.PriceList {
+			rate, err := onDemandPrice(s, r.currency)
+			if err != nil {
+				return 0, err
+			}
+			if rate > 0 {
+				return rate, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// annotateRates sets OnDemandRate of on-demand instances of EC2 reports
+func annotateRates(ctx context.Context, rates *onDemandRates, reps []*report) error {
+	for _, rep := range reps {
+		if rep.Service != "" && rep.Service != "ec2" {
+			continue
+		}
+		for i, v := range rep.OnDemandInstances {
+			rate, err := rates.rate(ctx, rep.Region, v.Key())
+			if err != nil {
+				return err
+			}
+			rep.OnDemandInstances[i].OnDemandRate = rate
+		}
+	}
+	return nil
+}
+
+// rateNote returns note on hourly on-demand rate of instances, if it's known
+func rateNote(v reservations.Item, c *costEstimate) string {
+	if v.OnDemandRate == 0 || c == nil {
+		return ""
+	}
+	return "\t" + money(v.OnDemandRate, c.Currency) + "/h on-demand"
+}
+
+// priceListItem is the part of Price List product document holding on-demand
+// price
+type priceListItem struct {
+	Terms struct {
+		OnDemand map[string]struct {
+			PriceDimensions map[string]struct {
+				Unit         string            `json:"unit"`
+				PricePerUnit map[string]string `json:"pricePerUnit"`
+			} `json:"priceDimensions"`
+		} `json:"OnDemand"`
+	} `json:"terms"`
+}
+
+// onDemandPrice returns hourly price in currency from Price List product
+// document, or zero if document has none
+func onDemandPrice(doc, currency string) (float64, error) {
+	var item priceListItem
+	if err := json.Unmarshal([]byte(doc), &item); err != nil {
+		return 0, err
+	}
+	for _, term := range item.Terms.OnDemand {
+		for _, dim := range term.PriceDimensions {
+			if dim.Unit != "Hrs" {
+				continue
+			}
+			if v, err := strconv.ParseFloat(dim.PricePerUnit[currency], 64); err == nil && v > 0 {
+				return v, nil
+			}
+		}
+	}
+	return 0, nil
+}
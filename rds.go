@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// RDS reserved DB instances are Region-scoped and cover DB instances of the
+// same class, engine (reservation product description) and deployment.
+// Reservations of MySQL, MariaDB, PostgreSQL, Aurora and BYOL engines are size
+// flexible within class family, using the same normalization factors EC2 does;
+// Multi-AZ reservation covers twice as many units as Single-AZ one. For these
+// engines Multi-AZ DB instance is counted as two instances. Reservations of
+// other engines only cover DB instances of the same deployment, their Multi-AZ
+// DB instances are reported with "Multi-AZ" suffix of engine.
+
+// fetchRDS counts DB instances and active reserved DB instances
+func fetchRDS(ctx context.Context, account string, awsCfg aws.Config, cfg config, prog *progress) (*reservations.Inventory, *reservations.Reservations, error) {
+	svc := rds.NewFromConfig(awsCfg)
+	opts := cfg.options()
+	inv := reservations.NewInventory()
+	prog.Printf("fetching RDS DB instances in %s", awsCfg.Region)
+	p := rds.NewDescribeDBInstancesPaginator(svc, &rds.DescribeDBInstancesInput{})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, db := range page.DBInstances {
+			class := aws.ToString(db.DBInstanceClass)
+			switch status := aws.ToString(db.DBInstanceStatus); {
+			case class == "db.serverless", !opts.TypeSelected(class):
+				continue
+			case (status == "stopped" || status == "stopping") && !cfg.IncludeStopped:
+				continue
+			}
+			k, n := rdsKey(class, rdsEngine(aws.ToString(db.Engine), aws.ToString(db.LicenseModel)), aws.ToBool(db.MultiAZ), opts)
+			k.AZ = aws.ToString(db.AvailabilityZone)
+			inv.Running[k] += n
+		}
+	}
+	prog.Printf("fetching RDS reserved DB instances in %s", awsCfg.Region)
+	ris := reservations.NewReservations()
+	rp := rds.NewDescribeReservedDBInstancesPaginator(svc, &rds.DescribeReservedDBInstancesInput{})
+	for rp.HasMorePages() {
+		page, err := rp.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range page.ReservedDBInstances {
+			class := aws.ToString(r.DBInstanceClass)
+			if !opts.Active(aws.ToString(r.State)) || !opts.TypeSelected(class) {
+				continue
+			}
+			engine := rdsEngine(aws.ToString(r.ProductDescription), "")
+			k, n := rdsKey(class, engine, aws.ToBool(r.MultiAZ), opts)
+			n *= int(aws.ToInt32(r.DBInstanceCount))
+			if !opts.StrictTypes && rdsSizeFlexible(engine) && reservations.SizeUnits(class) > 0 {
+				ris.AddFlexible(class, k.Platform, n)
+				continue
+			}
+			ris.Region[k] += n
+		}
+	}
+	return inv, ris, nil
+}
+
+// rdsKey returns key DB instances or reservations are counted with, and how
+// many instances each of them is counted as
+func rdsKey(class, engine string, multiAZ bool, opts reservations.Options) (reservations.Key, int) {
+	k, n := reservations.Key{Type: class}, 1
+	switch {
+	case multiAZ && rdsSizeFlexible(engine):
+		n = 2
+	case multiAZ:
+		engine += " Multi-AZ"
+	}
+	if !opts.IgnorePlatform {
+		k.Platform = engine
+	}
+	return k, n
+}
+
+// rdsEngine returns DB instance engine in the form of reservation product
+// description, i.e. "postgresql" for "postgres" engine, or "oracle-se2(li)"
+// for license-included "oracle-se2". Licensing model is only taken into
+// account for engines where reservations depend on it; license is empty for
+// product descriptions.
+func rdsEngine(engine, license string) string {
+	switch {
+	case engine == "postgres":
+		return "postgresql"
+	case engine == "aurora":
+		// engine name of Aurora MySQL 1, also used in old reservations
+		return "aurora-mysql"
+	case strings.HasPrefix(engine, "oracle-"), strings.HasPrefix(engine, "sqlserver-"), strings.HasPrefix(engine, "db2-"):
+		switch license {
+		case "license-included":
+			return engine + "(li)"
+		case "bring-your-own-license":
+			return engine + "(byol)"
+		}
+	}
+	return engine
+}
+
+// rdsSizeFlexible reports whether reservations of engine in product
+// description form are size flexible
+func rdsSizeFlexible(engine string) bool {
+	switch engine {
+	case "mysql", "mariadb", "postgresql", "aurora-mysql", "aurora-postgresql":
+		return true
+	}
+	return strings.HasSuffix(engine, "(byol)")
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// exchangeSuggestion is an advisory candidate for convertible reservation
+// exchange: unused convertible reservations of one family could be exchanged
+// to cover on-demand instances of another family. Actual exchange is subject
+// to AWS exchange value rules, so counts are only a hint.
+type exchangeSuggestion struct {
+	From     string `json:"from"`     // instance type of unused convertible reservations
+	Count    int    `json:"count"`    // number of such reservations suggested for exchange
+	ToFamily string `json:"toFamily"` // instance family having on-demand instances
+	Gap      int    `json:"gap"`      // number of on-demand instances in ToFamily
+
+	Quote *exchangeQuote `json:"quote,omitempty"` // only set with -exchange-quotes
+}
+
+// suggestExchanges matches unused convertible reservations against on-demand
+// instances of other families. convertible maps instance type to the number of
+// convertible reservations of this type; unused reservations of a type are
+// only considered up to this number.
+func suggestExchanges(onDemand, unused []reservations.Item, convertible map[string]int) []exchangeSuggestion {
+	gaps := make(map[string]int)
+	for _, v := range onDemand {
+		gaps[reservations.Family(v.Type)] += v.Count
+	}
+	surplus := make(map[string]int)
+	for _, v := range unused {
+		surplus[v.Type] += v.Count
+	}
+	for typ, n := range surplus {
+		if n > convertible[typ] {
+			n = convertible[typ]
+		}
+		if n <= 0 {
+			delete(surplus, typ)
+			continue
+		}
+		surplus[typ] = n
+	}
+	if len(gaps) == 0 || len(surplus) == 0 {
+		return nil
+	}
+	families := make([]string, 0, len(gaps))
+	for f := range gaps {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		if gaps[families[i]] != gaps[families[j]] {
+			return gaps[families[i]] > gaps[families[j]]
+		}
+		return families[i] < families[j]
+	})
+	types := make([]string, 0, len(surplus))
+	for t := range surplus {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	var out []exchangeSuggestion
+	for _, fam := range families {
+		need := gaps[fam]
+		for _, typ := range types {
+			if need == 0 {
+				break
+			}
+			if surplus[typ] == 0 || reservations.Family(typ) == fam {
+				continue
+			}
+			n := surplus[typ]
+			if n > need {
+				n = need
+			}
+			out = append(out, exchangeSuggestion{From: typ, Count: n, ToFamily: fam, Gap: gaps[fam]})
+			surplus[typ] -= n
+			need -= n
+		}
+	}
+	return out
+}
+
+func writeExchangeSuggestions(w io.Writer, sugs []exchangeSuggestion) {
+	if len(sugs) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Convertible reservation exchange candidates (convertible RIs only, advisory):")
+	for _, s := range sugs {
+		fmt.Fprintf(w, "%s\t%d\t-> %s family (%d on-demand)\n", s.From, s.Count, s.ToFamily, s.Gap)
+		writeExchangeQuote(w, s.Quote)
+	}
+}
+
+// purchase is a recommended reservation purchase
+type purchase struct {
+	Account  string `json:"account,omitempty"`
+	Region   string `json:"region"`
+	Type     string `json:"type"`
+	Count    int    `json:"count"`
+	Platform string `json:"platform,omitempty"`
+	Tenancy  string `json:"tenancy,omitempty"`
+	Scope    string `json:"scope"`
+	// Flexible is set for size-flexible reservations, which cover any
+	// size of the family; Count is then expressed in Type size
+	Flexible bool   `json:"flexible,omitempty"`
+	Savings  string `json:"estimatedMonthlySavings,omitempty"` // only set by Cost Explorer
+
+	BreakEven *breakEven `json:"breakEven,omitempty"` // only set with -costs
+}
+
+// recommendPurchases returns Region-scoped reservations covering on-demand
+// instances of report, just enough to reach target coverage percentage.
+// Instance types with more on-demand instances are covered first. Linux/UNIX
+// instances with default tenancy are grouped per family into size-flexible
+// reservations of the smallest size seen, unless strict is set.
+func recommendPurchases(rep *report, target float64, strict bool) []purchase {
+	need := int(math.Ceil(target*float64(rep.Running)/100)) - (rep.Running - rep.Uncovered() + rep.savingsPlansCovered())
+	if need <= 0 {
+		return nil
+	}
+	var items []reservations.Item
+	for _, v := range rep.OnDemandInstances {
+		// instances covered by Savings Plans don't need reservations
+		if v.Count -= v.SavingsPlans; v.Count > 0 {
+			items = append(items, v)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Count > items[j].Count })
+	var out []purchase
+	flex := make(map[string]int) // family to index in out
+	for _, v := range items {
+		if need <= 0 {
+			break
+		}
+		n := v.Count
+		if n > need {
+			n = need
+		}
+		need -= n
+		p := purchase{Account: rep.Account, Region: rep.Region, Type: v.Type, Count: n,
+			Platform: v.Platform, Tenancy: v.Tenancy, Scope: "Region"}
+		units := reservations.SizeUnits(v.Type)
+		if strict || units == 0 || v.Tenancy != "" || (v.Platform != "" && v.Platform != reservations.LinuxPlatform) {
+			out = append(out, p)
+			continue
+		}
+		fam := reservations.Family(v.Type)
+		i, ok := flex[fam]
+		if !ok {
+			p.Flexible = true
+			flex[fam] = len(out)
+			out = append(out, p)
+			continue
+		}
+		// keep the smallest size, re-expressing units already counted
+		total := out[i].Count*reservations.SizeUnits(out[i].Type) + n*units
+		if units < reservations.SizeUnits(out[i].Type) {
+			out[i].Type = v.Type
+		}
+		u := reservations.SizeUnits(out[i].Type)
+		out[i].Count = (total + u - 1) / u
+	}
+	return mergePurchases(out)
+}
+
+// mergePurchases sums counts of non-flexible purchases of the same type,
+// platform and tenancy, which come from different AZs
+func mergePurchases(ps []purchase) []purchase {
+	type key struct{ typ, platform, tenancy string }
+	idx := make(map[key]int)
+	var out []purchase
+	for _, p := range ps {
+		k := key{p.Type, p.Platform, p.Tenancy}
+		if i, ok := idx[k]; ok && !p.Flexible && !out[i].Flexible {
+			out[i].Count += p.Count
+			continue
+		}
+		idx[k] = len(out)
+		out = append(out, p)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+	return out
+}
+
+// recommend writes reservation purchases covering on-demand instances up to
+// target coverage set by cfg. In consolidated billing view purchases are
+// recommended for aggregated reports.
+func recommend(ctx context.Context, w io.Writer, cfg config) error {
+	if _, ok := services[cfg.Service]; ok || cfg.Service == allServices {
+		return fmt.Errorf("recommend command only supports -service ec2")
+	}
+	if cfg.CoverageTarget <= 0 || cfg.CoverageTarget > 100 {
+		return fmt.Errorf("-coverage-target must be in (0, 100] range")
+	}
+	if cfg.CostExplorer || cfg.SavingsPlans {
+		if _, err := lookbackPeriod(cfg.LookbackDays); err != nil {
+			return err
+		}
+	}
+	offeringType, ok := paymentOptions[cfg.PaymentOption]
+	if cfg.Costs && !ok {
+		return fmt.Errorf("-payment-option must be one of all-upfront, partial-upfront or no-upfront")
+	}
+	ctx, cancel := cfg.withTimeout(ctx)
+	defer cancel()
+	// unused reservations utilization is not needed here
+	collectCfg := cfg
+	collectCfg.CostExplorer = false
+	res, err := collect(ctx, collectCfg)
+	if err != nil {
+		return err
+	}
+	var awsCfg aws.Config
+	if cfg.Costs || cfg.CostExplorer || cfg.SavingsPlans {
+		if awsCfg, err = newAWSConfig(ctx, cfg); err != nil {
+			return err
+		}
+	}
+	rec := recommendation{Purchases: make([]purchase, 0)}
+	for _, rep := range res.billed() {
+		ps := recommendPurchases(rep, cfg.CoverageTarget, cfg.StrictTypes)
+		if cfg.Costs && len(ps) > 0 {
+			regionCfg := awsCfg.Copy()
+			regionCfg.Region = rep.Region
+			if err := annotateBreakEven(ctx, ec2.NewFromConfig(regionCfg), rep, ps, offeringType, cfg.Currency); err != nil {
+				return fmt.Errorf("break-even: %w", err)
+			}
+		}
+		rec.Purchases = append(rec.Purchases, ps...)
+	}
+	if cfg.CostExplorer || cfg.SavingsPlans {
+		ris, err := fetchCERecommendations(ctx, awsCfg, cfg.LookbackDays, cfg.Float)
+		if err != nil {
+			return fmt.Errorf("cost explorer: %w", err)
+		}
+		if cfg.CostExplorer {
+			rec.CostExplorer = ris
+		}
+		if cfg.SavingsPlans {
+			if rec.SavingsPlan, err = fetchSavingsPlanRecommendation(ctx, awsCfg, cfg.LookbackDays, cfg.Float, ris); err != nil {
+				return fmt.Errorf("cost explorer: %w", err)
+			}
+		}
+	}
+	if cfg.Format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rec)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	if len(rec.Purchases) == 0 {
+		fmt.Fprintf(tw, "Coverage target of %g%% is met, nothing to purchase.\n", cfg.CoverageTarget)
+	}
+	writePurchases(tw, rec.Purchases)
+	if cfg.CostExplorer {
+		fmt.Fprintf(tw, "Cost Explorer recommendations, based on %d days of usage (1 year, no upfront):\n", cfg.LookbackDays)
+		if len(rec.CostExplorer) == 0 {
+			fmt.Fprintln(tw, "none")
+		}
+		writePurchases(tw, rec.CostExplorer)
+	}
+	writeSavingsPlanComparison(tw, rec.SavingsPlan)
+	return tw.Flush()
+}
+
+// recommendation is the outcome of recommend command
+type recommendation struct {
+	Purchases    []purchase `json:"purchases"`              // based on current on-demand instances
+	CostExplorer []purchase `json:"costExplorer,omitempty"` // based on usage history
+
+	SavingsPlan *savingsPlanComparison `json:"savingsPlan,omitempty"` // only set with -savings-plans
+}
+
+func writePurchases(w io.Writer, ps []purchase) {
+	for _, p := range ps {
+		loc := p.Region
+		if p.Account != "" {
+			loc = p.Account + "/" + p.Region
+		}
+		note := p.Scope
+		if p.Flexible {
+			note += ", size-flexible (any " + reservations.Family(p.Type) + " size)"
+		}
+		if p.Savings != "" {
+			note += ", saves " + p.Savings + "/month"
+		}
+		note += breakEvenNote(p)
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", p.Type, p.Count, loc, p.Platform, p.Tenancy, note)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// defaultDir is the directory name used for the account of base config when
+// recording responses
+const defaultDir = "default"
+
+// Recorded responses are kept in -record directory, one subdirectory per
+// account and region, i.e. default/us-east-1 or 123456789012/eu-west-1. Each
+// response is a JSON file named after API operation and page number:
+// DescribeInstances-1.json, DescribeInstances-2.json,
+// DescribeReservedInstances-1.json. Pagination tokens are not kept, on replay
+// pages are returned in the order they were recorded.
+
+// recorder is ec2API saving responses of the wrapped ec2API to directory
+type recorder struct {
+	ec2API
+	dir string
+
+	mu    sync.Mutex
+	pages map[string]int // operation to number of pages saved
+}
+
+func newRecorder(svc ec2API, dir string) *recorder {
+	return &recorder{ec2API: svc, dir: dir, pages: make(map[string]int)}
+}
+
+// save writes response of operation op to the next page file
+func (r *recorder) save(op string, v interface{}) error {
+	r.mu.Lock()
+	r.pages[op]++
+	page := r.pages[op]
+	r.mu.Unlock()
+	if err := os.MkdirAll(r.dir, 0777); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(pageFile(r.dir, op, page), b, 0666)
+}
+
+func (r *recorder) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	out, err := r.ec2API.DescribeInstances(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeInstances", out)
+}
+
+func (r *recorder) DescribeReservedInstances(ctx context.Context, params *ec2.DescribeReservedInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesOutput, error) {
+	out, err := r.ec2API.DescribeReservedInstances(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeReservedInstances", out)
+}
+
+func (r *recorder) DescribeReservedInstancesModifications(ctx context.Context, params *ec2.DescribeReservedInstancesModificationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesModificationsOutput, error) {
+	out, err := r.ec2API.DescribeReservedInstancesModifications(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeReservedInstancesModifications", out)
+}
+
+func (r *recorder) DescribeCapacityReservations(ctx context.Context, params *ec2.DescribeCapacityReservationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeCapacityReservationsOutput, error) {
+	out, err := r.ec2API.DescribeCapacityReservations(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeCapacityReservations", out)
+}
+
+func (r *recorder) DescribeCapacityReservationFleets(ctx context.Context, params *ec2.DescribeCapacityReservationFleetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeCapacityReservationFleetsOutput, error) {
+	out, err := r.ec2API.DescribeCapacityReservationFleets(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeCapacityReservationFleets", out)
+}
+
+func (r *recorder) DescribeHosts(ctx context.Context, params *ec2.DescribeHostsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeHostsOutput, error) {
+	out, err := r.ec2API.DescribeHosts(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeHosts", out)
+}
+
+func (r *recorder) DescribeHostReservations(ctx context.Context, params *ec2.DescribeHostReservationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeHostReservationsOutput, error) {
+	out, err := r.ec2API.DescribeHostReservations(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeHostReservations", out)
+}
+
+func (r *recorder) DescribeReservedInstancesListings(ctx context.Context, params *ec2.DescribeReservedInstancesListingsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesListingsOutput, error) {
+	out, err := r.ec2API.DescribeReservedInstancesListings(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	return out, r.save("DescribeReservedInstancesListings", out)
+}
+
+// replayer is ec2API returning responses saved by recorder
+type replayer struct {
+	dir string
+}
+
+// load reads page of operation op selected by token into v and returns token
+// of the next page, or nil if it's the last one. Missing first page is an
+// error only if required is set, otherwise v is left empty.
+func (r replayer) load(op string, token *string, required bool, v interface{}) (*string, error) {
+	page := 1
+	if token != nil {
+		var err error
+		if page, err = strconv.Atoi(*token); err != nil {
+			return nil, fmt.Errorf("invalid replay page token %q", *token)
+		}
+	}
+	b, err := os.ReadFile(pageFile(r.dir, op, page))
+	if errors.Is(err, fs.ErrNotExist) && page == 1 && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, fmt.Errorf("%s: %w", pageFile(r.dir, op, page), err)
+	}
+	if _, err := os.Stat(pageFile(r.dir, op, page+1)); err == nil {
+		return aws.String(strconv.Itoa(page + 1)), nil
+	}
+	return nil, nil
+}
+
+func (r replayer) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	out := new(ec2.DescribeInstancesOutput)
+	var err error
+	out.NextToken, err = r.load("DescribeInstances", params.NextToken, true, out)
+	return out, err
+}
+
+func (r replayer) DescribeReservedInstances(ctx context.Context, params *ec2.DescribeReservedInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesOutput, error) {
+	out := new(ec2.DescribeReservedInstancesOutput)
+	_, err := r.load("DescribeReservedInstances", nil, true, out)
+	return out, err
+}
+
+func (r replayer) DescribeReservedInstancesModifications(ctx context.Context, params *ec2.DescribeReservedInstancesModificationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesModificationsOutput, error) {
+	out := new(ec2.DescribeReservedInstancesModificationsOutput)
+	var err error
+	// modifications are only recorded with -modifications
+	out.NextToken, err = r.load("DescribeReservedInstancesModifications", params.NextToken, false, out)
+	return out, err
+}
+
+func (r replayer) DescribeCapacityReservations(ctx context.Context, params *ec2.DescribeCapacityReservationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeCapacityReservationsOutput, error) {
+	out := new(ec2.DescribeCapacityReservationsOutput)
+	var err error
+	// capacity reservations are only recorded with -capacity-reservations
+	out.NextToken, err = r.load("DescribeCapacityReservations", params.NextToken, false, out)
+	return out, err
+}
+
+func (r replayer) DescribeCapacityReservationFleets(ctx context.Context, params *ec2.DescribeCapacityReservationFleetsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeCapacityReservationFleetsOutput, error) {
+	out := new(ec2.DescribeCapacityReservationFleetsOutput)
+	var err error
+	out.NextToken, err = r.load("DescribeCapacityReservationFleets", params.NextToken, false, out)
+	return out, err
+}
+
+func (r replayer) DescribeHosts(ctx context.Context, params *ec2.DescribeHostsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeHostsOutput, error) {
+	out := new(ec2.DescribeHostsOutput)
+	var err error
+	out.NextToken, err = r.load("DescribeHosts", params.NextToken, false, out)
+	return out, err
+}
+
+func (r replayer) DescribeHostReservations(ctx context.Context, params *ec2.DescribeHostReservationsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeHostReservationsOutput, error) {
+	out := new(ec2.DescribeHostReservationsOutput)
+	var err error
+	out.NextToken, err = r.load("DescribeHostReservations", params.NextToken, false, out)
+	return out, err
+}
+
+func (r replayer) DescribeReservedInstancesListings(ctx context.Context, params *ec2.DescribeReservedInstancesListingsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesListingsOutput, error) {
+	out := new(ec2.DescribeReservedInstancesListingsOutput)
+	// listings are only recorded with -listings or -exclude-listed
+	_, err := r.load("DescribeReservedInstancesListings", nil, false, out)
+	return out, err
+}
+
+func pageFile(dir, op string, page int) string {
+	return filepath.Join(dir, op+"-"+strconv.Itoa(page)+".json")
+}
+
+// replayJobs returns jobs replaying responses recorded to dir, one per
+// account and region subdirectory
+func replayJobs(dir string) ([]job, error) {
+	dirs, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var jobs []job
+	regions := make(map[string]struct{})
+	for _, d := range dirs {
+		if st, err := os.Stat(d); err != nil || !st.IsDir() {
+			continue
+		}
+		account, region := filepath.Base(filepath.Dir(d)), filepath.Base(d)
+		if account == defaultDir {
+			account = ""
+		}
+		regions[region] = struct{}{}
+		jobs = append(jobs, job{account: account, region: region,
+			awsCfg: aws.Config{Region: region}, svc: replayer{dir: d}})
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no recorded responses found in %s", dir)
+	}
+	// keep single region reports looking the same as when they were
+	// recorded
+	if len(regions) == 1 {
+		for i := range jobs {
+			jobs[i].region = ""
+		}
+	}
+	return jobs, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	res, err := inspectAll(context.Background(), parseConfig(t, "-replay", "testdata/replay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.multiRegion || res.multiAccount {
+		t.Errorf("got multiRegion %v, multiAccount %v; want true, false", res.multiRegion, res.multiAccount)
+	}
+	type want struct{ running, uncovered, unused int }
+	wants := map[string]want{
+		// m5 instances are covered by size-flexible reservations, t3.micro
+		// reservations are in a zone without instances
+		"us-east-1": {running: 4, uncovered: 1, unused: 2},
+		"eu-west-1": {running: 1},
+	}
+	if len(res.Reports) != len(wants) {
+		t.Fatalf("got %d reports, want %d", len(res.Reports), len(wants))
+	}
+	for _, rep := range res.Reports {
+		w, ok := wants[rep.Region]
+		if !ok {
+			t.Errorf("unexpected report of region %q", rep.Region)
+			continue
+		}
+		if got := (want{rep.Running, rep.Uncovered(), rep.Unused()}); got != w {
+			t.Errorf("%s: got %+v, want %+v", rep.Region, got, w)
+		}
+	}
+}
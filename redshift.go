@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/redshift"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// fetchRedshift counts nodes of provisioned Redshift clusters and active
+// reserved nodes. Reserved nodes are Region-scoped and only cover nodes of the
+// same type.
+func fetchRedshift(ctx context.Context, account string, awsCfg aws.Config, cfg config, prog *progress) (*reservations.Inventory, *reservations.Reservations, error) {
+	svc := redshift.NewFromConfig(awsCfg)
+	opts := cfg.options()
+	inv := reservations.NewInventory()
+	prog.Printf("fetching Redshift clusters in %s", awsCfg.Region)
+	p := redshift.NewDescribeClustersPaginator(svc, &redshift.DescribeClustersInput{})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range page.Clusters {
+			typ := aws.ToString(c.NodeType)
+			switch status := aws.ToString(c.ClusterStatus); {
+			case !opts.TypeSelected(typ):
+				continue
+			case (status == "paused" || status == "pausing") && !cfg.IncludeStopped:
+				// paused clusters are not billed for nodes
+				continue
+			}
+			k := reservations.Key{Type: typ, AZ: aws.ToString(c.AvailabilityZone)}
+			inv.Running[k] += int(aws.ToInt32(c.NumberOfNodes))
+		}
+	}
+	prog.Printf("fetching Redshift reserved nodes in %s", awsCfg.Region)
+	ris := reservations.NewReservations()
+	rp := redshift.NewDescribeReservedNodesPaginator(svc, &redshift.DescribeReservedNodesInput{})
+	for rp.HasMorePages() {
+		page, err := rp.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range page.ReservedNodes {
+			typ := aws.ToString(r.NodeType)
+			if !opts.Active(aws.ToString(r.State)) || !opts.TypeSelected(typ) {
+				continue
+			}
+			ris.Region[reservations.Key{Type: typ}] += int(aws.ToInt32(r.NodeCount))
+		}
+	}
+	return inv, ris, nil
+}
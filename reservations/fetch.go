@@ -0,0 +1,81 @@
+package reservations
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// EC2API is the subset of EC2 API this package uses, *ec2.Client implements
+// it. Consumers may supply fakes or instrumented clients instead.
+type EC2API interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	DescribeReservedInstances(ctx context.Context, params *ec2.DescribeReservedInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesOutput, error)
+}
+
+var _ EC2API = (*ec2.Client)(nil)
+
+// FetchInventory counts instances returned by DescribeInstances with given
+// input. If input is nil, all running instances are counted. Instances are
+// counted as pages arrive, pages are not kept, so memory use depends on page
+// size and number of distinct types, not on fleet size.
+func FetchInventory(ctx context.Context, svc EC2API, input *ec2.DescribeInstancesInput, opts Options) (*Inventory, error) {
+	if input == nil {
+		input = &ec2.DescribeInstancesInput{
+			Filters: []types.Filter{{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"running"},
+			}},
+		}
+	}
+	inv := NewInventory()
+	opts.logf("fetching instances")
+	var pages int
+	paginator := ec2.NewDescribeInstancesPaginator(svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pages++
+		for _, r := range page.Reservations {
+			for i := range r.Instances {
+				inv.Add(&r.Instances[i], opts)
+			}
+		}
+		opts.logf("fetched instances page %d", pages)
+		if opts.MaxPages > 0 && pages >= opts.MaxPages && paginator.HasMorePages() {
+			inv.Truncated = true
+			break
+		}
+	}
+	return inv, nil
+}
+
+// FetchReservations counts active reserved instances, and ones pending
+// payment with Options.PaymentPending. Queued purchases are kept in
+// Reservations.Queued.
+func FetchReservations(ctx context.Context, svc EC2API, opts Options) (*Reservations, error) {
+	opts.logf("fetching reserved instances")
+	// DescribeReservedInstances is not paginated, it returns all matching
+	// reservations in a single response
+	out, err := svc.DescribeReservedInstances(ctx, &ec2.DescribeReservedInstancesInput{
+		Filters: []types.Filter{{
+			Name:   aws.String("state"),
+			Values: append(opts.States(), string(types.ReservedInstanceStateQueued)),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts.logf("fetched %d reserved instances", len(out.ReservedInstances))
+	rs := NewReservations()
+	for i := range out.ReservedInstances {
+		if err := rs.Add(&out.ReservedInstances[i], opts); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
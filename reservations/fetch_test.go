@@ -0,0 +1,108 @@
+package reservations
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// fakeEC2 serves instances in pages, using page index as next token, and
+// a fixed set of reservations
+type fakeEC2 struct {
+	pages    [][]running
+	reserved []reserved
+	calls    int // DescribeInstances calls made
+}
+
+func (f *fakeEC2) DescribeInstances(ctx context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.calls++
+	var i int
+	if in.NextToken != nil {
+		var err error
+		if i, err = strconv.Atoi(*in.NextToken); err != nil {
+			return nil, err
+		}
+	}
+	out := &ec2.DescribeInstancesOutput{}
+	if i < len(f.pages) {
+		var r types.Reservation
+		for _, inst := range f.pages[i] {
+			r.Instances = append(r.Instances, *inst.instance())
+		}
+		out.Reservations = []types.Reservation{r}
+	}
+	if i+1 < len(f.pages) {
+		out.NextToken = aws.String(strconv.Itoa(i + 1))
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) DescribeReservedInstances(ctx context.Context, in *ec2.DescribeReservedInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeReservedInstancesOutput, error) {
+	out := &ec2.DescribeReservedInstancesOutput{}
+	for _, r := range f.reserved {
+		ri := r.reservation()
+		ri.State = types.ReservedInstanceStateActive
+		out.ReservedInstances = append(out.ReservedInstances, *ri)
+	}
+	return out, nil
+}
+
+func TestFetchInventory(t *testing.T) {
+	pages := [][]running{
+		{{typ: "m5.large", az: "us-east-1a"}, {typ: "m5.large", az: "us-east-1a"}},
+		{{typ: "c5.large", az: "us-east-1b"}},
+		{{typ: "m5.large", az: "us-east-1a"}},
+	}
+	table := []struct {
+		maxPages  int
+		calls     int
+		total     int
+		truncated bool
+	}{
+		{maxPages: 0, calls: 3, total: 4},
+		{maxPages: 3, calls: 3, total: 4},
+		{maxPages: 2, calls: 2, total: 3, truncated: true},
+		{maxPages: 1, calls: 1, total: 2, truncated: true},
+	}
+	for _, tc := range table {
+		svc := &fakeEC2{pages: pages}
+		inv, err := FetchInventory(context.Background(), svc, nil, Options{MaxPages: tc.maxPages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if svc.calls != tc.calls || inv.Total() != tc.total || inv.Truncated != tc.truncated {
+			t.Errorf("max pages %d: got %d calls, %d instances, truncated %v; want %d, %d, %v",
+				tc.maxPages, svc.calls, inv.Total(), inv.Truncated, tc.calls, tc.total, tc.truncated)
+		}
+	}
+}
+
+func TestFetchReconcile(t *testing.T) {
+	svc := &fakeEC2{
+		pages: [][]running{
+			{{typ: "m5.large", az: "us-east-1a"}, {typ: "m5.xlarge", az: "us-east-1a"}},
+			{{typ: "m5.xlarge", az: "us-east-1b"}, {typ: "c5.large", az: "us-east-1a"}},
+		},
+		reserved: []reserved{{typ: "m5.2xlarge", count: 1}, {typ: "m5.large", count: 1}},
+	}
+	ctx := context.Background()
+	inv, err := FetchInventory(ctx, svc, nil, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := FetchReservations(ctx, svc, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := Reconcile(inv, rs)
+	want := map[string]int{"c5.large " + LinuxPlatform: 1}
+	if got := counts(res.OnDemandInstances); res.Running != 4 || !reflect.DeepEqual(got, want) || len(res.UnusedReservations) != 0 {
+		t.Errorf("got %d running, %v on-demand, %v unused; want 4, %v, none",
+			res.Running, got, res.UnusedReservations, want)
+	}
+}
@@ -0,0 +1,235 @@
+package reservations
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Region-scoped Linux/UNIX reservations with default tenancy are size
+// flexible: AWS applies them to any size within the instance family, using
+// normalization factors (small is 1, medium is 2, large is 4, xlarge is 8, and
+// so on). Such reservations are pooled per family in normalized units and
+// applied to running instances of the family regardless of their size and AZ.
+//
+// Example, in SizeUnits units (normalization factor multiplied by 4): one
+// m5.2xlarge (64 units) and one m5.large (16 units) regional reservations
+// form an 80-unit m5 pool. With running m5.large, m5.xlarge in us-east-1a and
+// m5.xlarge in us-east-1b (16+32+32=80 units) every instance is covered. If
+// only m5.large and m5.xlarge are running, 32 units remain unused and are
+// reported as two unused m5.large reservations, the largest purchased size
+// that fits them. Regional Windows m5.large reservation is not pooled, it only
+// covers m5.large instance.
+//
+// Bare metal sizes have the factor of the largest size in the family:
+// m5.metal is the same 768 units as m5.24xlarge, m7i.metal-48xl is the same
+// as m7i.48xlarge.
+
+// SizeUnits returns normalization factor of instance type size multiplied by
+// 4, so that nano (factor 0.25) is 1 unit. It returns 0 for sizes without
+// known factor, like metal size of a family missing from metalSizes.
+func SizeUnits(typ string) int {
+	i := strings.LastIndexByte(typ, '.')
+	if i < 0 {
+		return 0
+	}
+	switch size := typ[i+1:]; size {
+	case "metal":
+		if s, ok := metalSizes[typ[:i]]; ok {
+			return SizeUnits(typ[:i] + "." + s)
+		}
+	case "nano":
+		return 1
+	case "micro":
+		return 2
+	case "small":
+		return 4
+	case "medium":
+		return 8
+	case "large":
+		return 16
+	case "xlarge":
+		return 32
+	default:
+		if strings.HasPrefix(size, "metal-") && strings.HasSuffix(size, "xl") {
+			size = strings.TrimPrefix(size, "metal-") + "arge" // metal-48xl -> 48xlarge
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(size, "xlarge")); err == nil &&
+			n > 0 && strings.HasSuffix(size, "xlarge") {
+			return n * 32
+		}
+	}
+	return 0
+}
+
+// metalSizes maps instance family to the size its metal instances are
+// equivalent to
+var metalSizes = map[string]string{
+	"a1":     "4xlarge",
+	"c5":     "24xlarge",
+	"c5d":    "24xlarge",
+	"c5n":    "18xlarge",
+	"c6a":    "48xlarge",
+	"c6g":    "16xlarge",
+	"c6gd":   "16xlarge",
+	"c6i":    "32xlarge",
+	"c6id":   "32xlarge",
+	"c6in":   "32xlarge",
+	"c7a":    "48xlarge",
+	"c7g":    "16xlarge",
+	"c7gd":   "16xlarge",
+	"g4dn":   "16xlarge",
+	"i3":     "16xlarge",
+	"i3en":   "24xlarge",
+	"i4i":    "32xlarge",
+	"m5":     "24xlarge",
+	"m5d":    "24xlarge",
+	"m5dn":   "24xlarge",
+	"m5n":    "24xlarge",
+	"m5zn":   "12xlarge",
+	"m6a":    "48xlarge",
+	"m6g":    "16xlarge",
+	"m6gd":   "16xlarge",
+	"m6i":    "32xlarge",
+	"m6id":   "32xlarge",
+	"m7a":    "48xlarge",
+	"m7g":    "16xlarge",
+	"m7gd":   "16xlarge",
+	"r5":     "24xlarge",
+	"r5b":    "24xlarge",
+	"r5d":    "24xlarge",
+	"r5dn":   "24xlarge",
+	"r5n":    "24xlarge",
+	"r6a":    "48xlarge",
+	"r6g":    "16xlarge",
+	"r6gd":   "16xlarge",
+	"r6i":    "32xlarge",
+	"r6id":   "32xlarge",
+	"r7a":    "48xlarge",
+	"r7g":    "16xlarge",
+	"r7gd":   "16xlarge",
+	"x2gd":   "16xlarge",
+	"x2idn":  "32xlarge",
+	"x2iedn": "32xlarge",
+	"z1d":    "12xlarge",
+}
+
+// sizeFlexible reports whether reservation is applied to instances in
+// normalized units
+func sizeFlexible(r *types.ReservedInstances) bool {
+	if r.Scope != types.ScopeRegional || SizeUnits(string(r.InstanceType)) == 0 {
+		return false
+	}
+	if t := r.InstanceTenancy; t != "" && t != types.TenancyDefault {
+		return false
+	}
+	return reservationPlatform(r) == LinuxPlatform
+}
+
+// PoolKey identifies pool of size-flexible reservations
+type PoolKey struct {
+	Family   string
+	Platform string // platform pool applies to, empty if platform is not matched
+}
+
+// FlexPool holds size-flexible reservations of a single instance family and
+// platform
+type FlexPool struct {
+	Units int             // normalized units left, see SizeUnits
+	Types map[string]bool // instance types reservations were purchased for
+}
+
+// AddFlexible adds count Region-scoped reservations of given instance type to
+// the pool of its family and platform, to be applied to instances of any size
+// of the family. Add does it for size-flexible EC2 reservations, reservations
+// of other services that are size-flexible under their own rules (i.e. RDS
+// ones) may be added with it directly. Platform is empty if it's not matched.
+func (rs *Reservations) AddFlexible(typ, platform string, count int) {
+	pk := PoolKey{Family: Family(typ), Platform: platform}
+	p, ok := rs.Pools[pk]
+	if !ok {
+		p = &FlexPool{Types: make(map[string]bool)}
+		rs.Pools[pk] = p
+	}
+	p.Units += count * SizeUnits(typ)
+	p.Types[typ] = true
+}
+
+// applyFlexPools spends pooled units on instances lacking reservations in out,
+// which is reconcile's intermediate result. Within a family smaller instances
+// are covered first, as AWS does. Instance that can only be partially covered
+// with the units left is kept as on-demand, but the units are still spent on
+// it, since AWS applies them to this instance too. Units left unspent are
+// added to out as unused regional reservations expressed in concrete sizes.
+func applyFlexPools(out map[Key]int, pools map[PoolKey]*FlexPool) {
+	var keys []Key
+	for k, v := range out {
+		if p := pools[poolKey(k)]; v < 0 && p != nil && k.Tenancy == "" && SizeUnits(k.Type) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ui, uj := SizeUnits(keys[i].Type), SizeUnits(keys[j].Type)
+		if ui != uj {
+			return ui < uj
+		}
+		if keys[i].Type != keys[j].Type {
+			return keys[i].Type < keys[j].Type
+		}
+		return keys[i].AZ < keys[j].AZ
+	})
+	for _, k := range keys {
+		p := pools[poolKey(k)]
+		units := SizeUnits(k.Type)
+		covered := p.Units / units
+		if covered > -out[k] {
+			covered = -out[k]
+		}
+		out[k] += covered
+		p.Units -= covered * units
+		if out[k] < 0 && p.Units > 0 {
+			p.Units = 0 // partially covers next instance
+		}
+	}
+	for pk, p := range pools {
+		for typ, n := range unitsToSizes(pk.Family, p) {
+			out[Key{Type: typ, Platform: pk.Platform}] += n
+		}
+	}
+}
+
+// poolKey returns key of the pool that may cover instances with key k
+func poolKey(k Key) PoolKey {
+	return PoolKey{Family: Family(k.Type), Platform: k.Platform}
+}
+
+// standardSizes are used to express units left after purchased sizes can no
+// longer fit them
+var standardSizes = []string{"xlarge", "large", "medium", "small", "micro", "nano"}
+
+// unitsToSizes expresses units left in pool as instance counts, preferring
+// instance types reservations were purchased for, largest first.
+func unitsToSizes(fam string, p *FlexPool) map[string]int {
+	if p.Units <= 0 {
+		return nil
+	}
+	types := make([]string, 0, len(p.Types)+len(standardSizes))
+	for t := range p.Types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return SizeUnits(types[i]) > SizeUnits(types[j]) })
+	for _, s := range standardSizes {
+		types = append(types, fam+"."+s)
+	}
+	out := make(map[string]int)
+	units := p.Units
+	for _, t := range types {
+		if u := SizeUnits(t); u <= units {
+			out[t] += units / u
+			units %= u
+		}
+	}
+	return out
+}
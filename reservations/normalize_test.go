@@ -0,0 +1,22 @@
+package reservations
+
+import "testing"
+
+func TestSizeUnits(t *testing.T) {
+	for typ, want := range map[string]int{
+		"t3.nano":        1,
+		"m5.large":       16,
+		"m5.2xlarge":     64,
+		"m5.metal":       24 * 32,
+		"m6a.metal":      48 * 32,
+		"c7a.metal-48xl": 48 * 32,
+		"m7i.metal-48xl": 48 * 32,
+		"x9.metal":       0,
+		"m7i.metal-xl":   0,
+		"m5":             0,
+	} {
+		if got := SizeUnits(typ); got != want {
+			t.Errorf("%s: got %d, want %d", typ, got, want)
+		}
+	}
+}
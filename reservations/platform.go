@@ -0,0 +1,55 @@
+package reservations
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// LinuxPlatform is the platform of plain Linux instances and reservations
+const LinuxPlatform = "Linux/UNIX"
+
+// instancePlatform returns instance platform in the form used by reservation
+// product descriptions, i.e. "Linux/UNIX", "Windows", "Red Hat Enterprise
+// Linux"
+func instancePlatform(inst *types.Instance) string {
+	if s := aws.ToString(inst.PlatformDetails); s != "" {
+		return s
+	}
+	if strings.EqualFold(string(inst.Platform), "windows") {
+		return "Windows"
+	}
+	return LinuxPlatform
+}
+
+// reservationPlatform returns reservation platform: its product description
+// without "(Amazon VPC)" suffix which is only present on old EC2-Classic era
+// reservations, and doesn't affect matching
+func reservationPlatform(r *types.ReservedInstances) string {
+	return strings.TrimSuffix(string(r.ProductDescription), " (Amazon VPC)")
+}
+
+// hostTenancy is tenancy of instances running on Dedicated Hosts
+const hostTenancy = "host"
+
+// instanceTenancy returns instance tenancy, empty for default (shared) tenancy
+func instanceTenancy(inst *types.Instance) string {
+	if inst.Placement == nil {
+		return ""
+	}
+	return normalizeTenancy(string(inst.Placement.Tenancy))
+}
+
+// reservationTenancy returns reservation tenancy, empty for default (shared)
+// tenancy
+func reservationTenancy(r *types.ReservedInstances) string {
+	return normalizeTenancy(string(r.InstanceTenancy))
+}
+
+func normalizeTenancy(s string) string {
+	if s == "default" {
+		return ""
+	}
+	return s
+}
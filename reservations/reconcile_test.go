@@ -0,0 +1,247 @@
+package reservations
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const windows = "Windows"
+
+// running describes a running instance in test fixtures
+type running struct {
+	typ, az, platform string
+}
+
+// reserved describes a reservation in test fixtures, empty az means
+// Region-scoped reservation
+type reserved struct {
+	typ, az, platform string
+	count             int32
+}
+
+func (r running) instance() *types.Instance {
+	platform := r.platform
+	if platform == "" {
+		platform = LinuxPlatform
+	}
+	return &types.Instance{
+		InstanceType:    types.InstanceType(r.typ),
+		Placement:       &types.Placement{AvailabilityZone: aws.String(r.az)},
+		PlatformDetails: aws.String(platform),
+	}
+}
+
+func (r reserved) reservation() *types.ReservedInstances {
+	platform := r.platform
+	if platform == "" {
+		platform = LinuxPlatform
+	}
+	out := &types.ReservedInstances{
+		InstanceType:       types.InstanceType(r.typ),
+		InstanceCount:      aws.Int32(r.count),
+		ProductDescription: types.RIProductDescription(platform),
+		Scope:              types.ScopeRegional,
+	}
+	if r.az != "" {
+		out.Scope = types.ScopeAvailabilityZone
+		out.AvailabilityZone = aws.String(r.az)
+	}
+	return out
+}
+
+// counts maps items to "type platform" → count, ignoring AZ and scope
+func counts(items []Item) map[string]int {
+	out := make(map[string]int)
+	for _, it := range items {
+		out[it.Type+" "+it.Platform] += it.Count
+	}
+	return out
+}
+
+func TestReconcile(t *testing.T) {
+	linux := func(typ string) string { return typ + " " + LinuxPlatform }
+	table := []struct {
+		name     string
+		running  []running
+		reserved []reserved
+		onDemand map[string]int
+		unused   map[string]int
+	}{
+		{
+			name: "mixed sizes fully covered",
+			running: []running{
+				{typ: "m5.large", az: "us-east-1a"},
+				{typ: "m5.xlarge", az: "us-east-1a"},
+				{typ: "m5.xlarge", az: "us-east-1b"},
+			},
+			reserved: []reserved{
+				{typ: "m5.2xlarge", count: 1},
+				{typ: "m5.large", count: 1},
+			},
+			onDemand: map[string]int{},
+			unused:   map[string]int{},
+		},
+		{
+			name: "leftover units expressed in purchased sizes",
+			running: []running{
+				{typ: "m5.large", az: "us-east-1a"},
+				{typ: "m5.xlarge", az: "us-east-1a"},
+			},
+			reserved: []reserved{
+				{typ: "m5.2xlarge", count: 1},
+				{typ: "m5.large", count: 1},
+			},
+			onDemand: map[string]int{},
+			unused:   map[string]int{linux("m5.large"): 2},
+		},
+		{
+			name: "smaller instances covered first",
+			running: []running{
+				{typ: "m5.large", az: "us-east-1a"},
+				{typ: "m5.xlarge", az: "us-east-1a"},
+				{typ: "m5.xlarge", az: "us-east-1b"},
+			},
+			reserved: []reserved{{typ: "m5.large", count: 3}},
+			onDemand: map[string]int{linux("m5.xlarge"): 1},
+			unused:   map[string]int{},
+		},
+		{
+			name:     "partial coverage spends the pool",
+			running:  []running{{typ: "m5.xlarge", az: "us-east-1a"}},
+			reserved: []reserved{{typ: "m5.large", count: 1}},
+			onDemand: map[string]int{linux("m5.xlarge"): 1},
+			unused:   map[string]int{},
+		},
+		{
+			name: "windows reservation is not pooled",
+			running: []running{
+				{typ: "m5.large", az: "us-east-1a", platform: windows},
+				{typ: "m5.xlarge", az: "us-east-1a", platform: windows},
+			},
+			reserved: []reserved{{typ: "m5.large", platform: windows, count: 2}},
+			onDemand: map[string]int{"m5.xlarge " + windows: 1},
+			unused:   map[string]int{"m5.large " + windows: 1},
+		},
+		{
+			name: "zonal reservation applied before pool",
+			running: []running{
+				{typ: "c5.large", az: "us-east-1a"},
+				{typ: "c5.large", az: "us-east-1b"},
+			},
+			reserved: []reserved{
+				{typ: "c5.large", az: "us-east-1a", count: 1},
+				{typ: "c5.xlarge", count: 1},
+			},
+			onDemand: map[string]int{},
+			unused:   map[string]int{linux("c5.large"): 1},
+		},
+	}
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			inv := NewInventory()
+			for _, r := range tc.running {
+				inv.Add(r.instance(), Options{})
+			}
+			rs := NewReservations()
+			for _, r := range tc.reserved {
+				if err := rs.Add(r.reservation(), Options{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res := Reconcile(inv, rs)
+			if res.Running != len(tc.running) {
+				t.Errorf("running: got %d, want %d", res.Running, len(tc.running))
+			}
+			if got := counts(res.OnDemandInstances); !reflect.DeepEqual(got, tc.onDemand) {
+				t.Errorf("on-demand: got %v, want %v", got, tc.onDemand)
+			}
+			if got := counts(res.UnusedReservations); !reflect.DeepEqual(got, tc.unused) {
+				t.Errorf("unused: got %v, want %v", got, tc.unused)
+			}
+			if again := Reconcile(inv, rs); !reflect.DeepEqual(res, again) {
+				t.Error("Reconcile modified its arguments")
+			}
+		})
+	}
+}
+
+func TestApplyFlexPoolsPartial(t *testing.T) {
+	k := Key{Type: "m5.xlarge", AZ: "us-east-1a", Platform: LinuxPlatform}
+	pk := PoolKey{Family: "m5", Platform: LinuxPlatform}
+	out := map[Key]int{k: -2}
+	pools := map[PoolKey]*FlexPool{pk: {Units: 48, Types: map[string]bool{"m5.large": true}}}
+	applyFlexPools(out, pools)
+	if out[k] != -1 {
+		t.Errorf("got %d uncovered, want 1", -out[k])
+	}
+	if pools[pk].Units != 0 {
+		t.Errorf("got %d units left, want 0: partially covered instance spends them", pools[pk].Units)
+	}
+}
+
+func TestUnitsToSizes(t *testing.T) {
+	table := []struct {
+		units int
+		types []string
+		want  map[string]int
+	}{
+		{units: 0, types: []string{"m5.large"}, want: nil},
+		{units: 128, types: []string{"m5.2xlarge", "m5.large"}, want: map[string]int{"m5.2xlarge": 2}},
+		{units: 80, types: []string{"m5.2xlarge", "m5.large"}, want: map[string]int{"m5.2xlarge": 1, "m5.large": 1}},
+		// remainder that purchased sizes can't fit is expressed in
+		// standard sizes
+		{units: 100, types: []string{"m5.2xlarge"}, want: map[string]int{"m5.2xlarge": 1, "m5.xlarge": 1, "m5.small": 1}},
+		{units: 7, types: []string{"t3.large"}, want: map[string]int{"t3.small": 1, "t3.micro": 1, "t3.nano": 1}},
+	}
+	for _, tc := range table {
+		p := &FlexPool{Units: tc.units, Types: make(map[string]bool)}
+		for _, typ := range tc.types {
+			p.Types[typ] = true
+		}
+		if got := unitsToSizes(Family(tc.types[0]), p); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%d units of %v: got %v, want %v", tc.units, tc.types, got, tc.want)
+		}
+	}
+}
+
+func TestInventorySkipsHosts(t *testing.T) {
+	inv := NewInventory()
+	for _, tenancy := range []types.Tenancy{types.TenancyDefault, types.TenancyDedicated, types.TenancyHost} {
+		inst := running{typ: "m5.large", az: "us-east-1a"}.instance()
+		inst.Placement.Tenancy = tenancy
+		inv.Add(inst, Options{})
+	}
+	want := map[Key]int{
+		{Type: "m5.large", AZ: "us-east-1a", Platform: LinuxPlatform}:                       1,
+		{Type: "m5.large", AZ: "us-east-1a", Platform: LinuxPlatform, Tenancy: "dedicated"}: 1,
+	}
+	if !reflect.DeepEqual(inv.Running, want) {
+		t.Errorf("got %v, want %v", inv.Running, want)
+	}
+}
+
+func TestInventoryClone(t *testing.T) {
+	inv := NewInventory()
+	inst := running{typ: "m5.large", az: "us-east-1a"}.instance()
+	inst.Tags = []types.Tag{
+		{Key: aws.String("team"), Value: aws.String("web")},
+		{Key: aws.String(autoScalingTag), Value: aws.String("web-asg")},
+		{Key: aws.String("eks:cluster-name"), Value: aws.String("prod")},
+		{Key: aws.String("eks:nodegroup-name"), Value: aws.String("default")},
+	}
+	inv.Add(inst, Options{GroupTag: "team", AutoScaling: true, Kubernetes: true})
+	clone := inv.Clone()
+	if !reflect.DeepEqual(clone, inv) {
+		t.Fatalf("got %+v, want %+v", clone, inv)
+	}
+	k := Key{Type: "m5.large", AZ: "us-east-1a", Platform: LinuxPlatform}
+	clone.Tagged["web"][k]++
+	clone.AutoScaling["web-asg"][k]++
+	clone.Kubernetes["prod/default"][k]++
+	if inv.Tagged["web"][k] != 1 || inv.AutoScaling["web-asg"][k] != 1 || inv.Kubernetes["prod/default"][k] != 1 {
+		t.Errorf("changing clone changed original: %+v", inv)
+	}
+}
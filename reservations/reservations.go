@@ -0,0 +1,656 @@
+// Package reservations reconciles running EC2 instances with active reserved
+// instances of a single account and region.
+//
+// Instances are counted into Inventory and reservations into Reservations,
+// either with FetchInventory and FetchReservations, or by calling their Add
+// methods on data obtained elsewhere. Reconcile then reports instances not
+// covered by any reservation and reservations not applied to any instance:
+//
+//	svc := ec2.NewFromConfig(awsCfg)
+//	inv, err := reservations.FetchInventory(ctx, svc, nil, reservations.Options{})
+//	...
+//	rs, err := reservations.FetchReservations(ctx, svc, reservations.Options{})
+//	...
+//	res := reservations.Reconcile(inv, rs)
+//
+// Instances are matched with reservations by type, platform, tenancy and
+// availability zone; Region-scoped size-flexible reservations are applied to
+// any size within instance family, see FlexPool.
+package reservations
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Options control how instances and reservations are counted
+type Options struct {
+	IgnorePlatform bool // match instances with reservations regardless of platform
+	StrictTypes    bool // don't apply size-flexible reservations across sizes
+	IncludeSpot    bool // count spot instances as demand
+	Spot           bool // count spot instances separately, in Inventory.Spot
+	PaymentPending bool // count reservations pending payment as active
+	ExcludeListed  bool // don't count reservations listed for sale, see Listed
+
+	// Listed is the number of instances of reservations listed for sale on
+	// Reserved Instance Marketplace and not sold yet, by reservation id
+	Listed map[string]int
+
+	Types        []string // if set, only instances and reservations of types matching these path.Match patterns are counted
+	ExcludeTypes []string // instances and reservations of types matching these patterns are skipped
+	AZs          []string // if set, only AZ-scoped reservations in these zones are counted
+
+	// Skip, if set, is called for every instance, instances it returns true
+	// for are not counted
+	Skip func(inst *types.Instance) bool
+
+	// GroupTag, if set, is the tag key instances are also counted by in
+	// Inventory.Tagged
+	GroupTag string
+	// AutoScaling enables counting instances per Auto Scaling group in
+	// Inventory.AutoScaling
+	AutoScaling bool
+	// Kubernetes enables counting Kubernetes nodes per cluster and node
+	// group in Inventory.Kubernetes
+	Kubernetes bool
+
+	MaxPages int // if positive, FetchInventory stops after this many pages
+
+	// Logf, if set, is called to report fetch progress
+	Logf func(format string, args ...interface{})
+}
+
+func (o Options) logf(format string, args ...interface{}) {
+	if o.Logf != nil {
+		o.Logf(format, args...)
+	}
+}
+
+// States returns states of reservations that are counted. FetchReservations
+// also fetches queued ones.
+func (o Options) States() []string {
+	if o.PaymentPending {
+		return []string{"active", "payment-pending"}
+	}
+	return []string{"active"}
+}
+
+// Active reports whether reservation in state is counted
+func (o Options) Active(state string) bool {
+	for _, s := range o.States() {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// TypeSelected reports whether instance type matches Types patterns (if any)
+// and doesn't match ExcludeTypes patterns
+func (o Options) TypeSelected(typ string) bool {
+	if len(o.Types) > 0 && !matchAny(o.Types, typ) {
+		return false
+	}
+	return !matchAny(o.ExcludeTypes, typ)
+}
+
+// matchAny reports whether s matches any of the patterns
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAZ reports whether AZ-scoped reservations in az are counted
+func (o Options) hasAZ(az string) bool {
+	if len(o.AZs) == 0 {
+		return true
+	}
+	for _, v := range o.AZs {
+		if v == az {
+			return true
+		}
+	}
+	return false
+}
+
+// Key is what instances and reservations are matched by
+type Key struct {
+	Type     string
+	AZ       string // empty for Region-scoped reservations
+	Platform string // empty if platform is not matched
+	Tenancy  string // empty for default (shared) tenancy
+}
+
+// Uncovered returns reported info on n on-demand instances
+func (k Key) Uncovered(n int) Item {
+	return Item{Type: k.Type, AZ: k.AZ, Platform: k.Platform, Tenancy: k.Tenancy, Count: n}
+}
+
+// Unused returns reported info on n unused reservations
+func (k Key) Unused(n int) Item {
+	return Item{Type: k.Type, AZ: k.AZ, Platform: k.Platform, Tenancy: k.Tenancy, Scope: scope(k), Count: n}
+}
+
+// scope returns scope of reservations reconcile reports with key k
+func scope(k Key) string {
+	if k.AZ != "" {
+		return "Availability Zone"
+	}
+	return "Region"
+}
+
+// Item is a reported number of instances or reservations
+type Item struct {
+	Type     string `json:"type"`
+	AZ       string `json:"az,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Tenancy  string `json:"tenancy,omitempty"`
+	Scope    string `json:"scope,omitempty"` // only set for reservations
+	Count    int    `json:"count"`
+
+	// Utilization is the percentage of reserved hours used over a period,
+	// it's not set by this package, but may be filled from billing data
+	Utilization *float64 `json:"utilization,omitempty"`
+	// SavingsPlans is the estimated number of on-demand instances covered
+	// by Savings Plans, it's not set by this package either
+	SavingsPlans int `json:"savingsPlans,omitempty"`
+	// OnDemandRate is the hourly on-demand price of a single instance, it's
+	// not set by this package, but may be filled from Price List API for
+	// on-demand instances
+	OnDemandRate float64 `json:"onDemandRate,omitempty"`
+	// End is the earliest end date of reservations item may be made of,
+	// only set for unused reservations added with Reservations.Add
+	End *time.Time `json:"end,omitempty"`
+	// Offering is payment terms of the same reservations, per instance of
+	// item type
+	Offering *Offering `json:"offering,omitempty"`
+}
+
+// Offering is payment terms of reservation, per instance
+type Offering struct {
+	Type       string  `json:"type"`       // No Upfront, Partial Upfront or All Upfront
+	FixedPrice float64 `json:"fixedPrice"` // paid upfront
+	Hourly     float64 `json:"hourly"`     // usage price and hourly recurring charges
+	Currency   string  `json:"currency,omitempty"`
+	Duration   int64   `json:"duration,omitempty"` // term in seconds
+}
+
+// offering returns payment terms of reservation
+func offering(r *types.ReservedInstances) Offering {
+	o := Offering{
+		Type:       string(r.OfferingType),
+		FixedPrice: float64(aws.ToFloat32(r.FixedPrice)),
+		Hourly:     float64(aws.ToFloat32(r.UsagePrice)),
+		Currency:   string(r.CurrencyCode),
+		Duration:   aws.ToInt64(r.Duration),
+	}
+	for _, c := range r.RecurringCharges {
+		if c.Frequency == types.RecurringChargeFrequencyHourly {
+			o.Hourly += aws.ToFloat64(c.Amount)
+		}
+	}
+	return o
+}
+
+// resize returns payment terms of size-flexible reservation of type from
+// re-expressed per instance of type to
+func (o Offering) resize(from, to string) Offering {
+	if from == to || SizeUnits(from) == 0 || SizeUnits(to) == 0 {
+		return o
+	}
+	f := float64(SizeUnits(to)) / float64(SizeUnits(from))
+	o.FixedPrice *= f
+	o.Hourly *= f
+	return o
+}
+
+// Key returns Key item was made from
+func (it Item) Key() Key {
+	return Key{Type: it.Type, AZ: it.AZ, Platform: it.Platform, Tenancy: it.Tenancy}
+}
+
+// Inventory holds instances of a single account and region
+type Inventory struct {
+	Running   map[Key]int // instances reservations apply to
+	Spot      map[Key]int // spot instances, only counted with Options.Spot
+	Truncated bool        // FetchInventory stopped after Options.MaxPages
+
+	// Tagged is Running split by value of Options.GroupTag tag, instances
+	// without the tag are counted under empty value
+	Tagged map[string]map[Key]int
+	// AutoScaling is the part of Running launched by Auto Scaling groups,
+	// by group name, only counted with Options.AutoScaling
+	AutoScaling map[string]map[Key]int
+	// Kubernetes is the part of Running being EKS or Karpenter nodes, by
+	// node group as returned by NodeGroup, only counted with
+	// Options.Kubernetes
+	Kubernetes map[string]map[Key]int
+}
+
+// autoScalingTag is the tag Auto Scaling sets on instances to the name of
+// their group
+const autoScalingTag = "aws:autoscaling:groupName"
+
+// NewInventory returns empty inventory, ready for instances to be added
+func NewInventory() *Inventory {
+	return &Inventory{Running: make(map[Key]int), Spot: make(map[Key]int)}
+}
+
+// Add counts instance according to opts. Instances other than on-demand and
+// spot ones (i.e. scheduled and capacity block instances) are never counted,
+// neither are instances on Dedicated Hosts: hosts are billed per host, so
+// reserved instances never cover them.
+func (inv *Inventory) Add(inst *types.Instance, opts Options) {
+	if opts.Skip != nil && opts.Skip(inst) || !opts.TypeSelected(string(inst.InstanceType)) {
+		return
+	}
+	k := Key{Type: string(inst.InstanceType)}
+	if inst.Placement != nil {
+		k.AZ = aws.ToString(inst.Placement.AvailabilityZone)
+	}
+	switch inst.InstanceLifecycle {
+	case "":
+	case types.InstanceLifecycleTypeSpot:
+		if !opts.IncludeSpot {
+			if opts.Spot {
+				inv.Spot[k]++
+			}
+			return
+		}
+	default:
+		return
+	}
+	if k.Tenancy = instanceTenancy(inst); k.Tenancy == hostTenancy {
+		return
+	}
+	if !opts.IgnorePlatform {
+		k.Platform = instancePlatform(inst)
+	}
+	inv.Running[k]++
+	if opts.GroupTag != "" {
+		value, _ := tagValue(inst.Tags, opts.GroupTag)
+		countGroup(&inv.Tagged, value, k)
+	}
+	if opts.AutoScaling {
+		if name, ok := tagValue(inst.Tags, autoScalingTag); ok {
+			countGroup(&inv.AutoScaling, name, k)
+		}
+	}
+	if opts.Kubernetes {
+		if group, ok := NodeGroup(inst.Tags); ok {
+			countGroup(&inv.Kubernetes, group, k)
+		}
+	}
+}
+
+// NodeGroup returns Kubernetes cluster and node group of instance in
+// "cluster/group" form, using tags EKS managed node groups, Karpenter and
+// eksctl set on nodes. Karpenter node pools are named "karpenter:pool",
+// nodes of a cluster without known node group are in "self-managed" group.
+// It returns false if tags don't mark instance as a node.
+func NodeGroup(tags []types.Tag) (string, bool) {
+	var cluster, group string
+	for _, t := range tags {
+		key, value := aws.ToString(t.Key), aws.ToString(t.Value)
+		switch key {
+		case "eks:cluster-name", "eks:eks-cluster-name", "alpha.eksctl.io/cluster-name":
+			cluster = value
+		case "eks:nodegroup-name", "alpha.eksctl.io/nodegroup-name":
+			group = value
+		case "karpenter.sh/nodepool", "karpenter.sh/provisioner-name":
+			group = "karpenter:" + value
+		default:
+			if name := strings.TrimPrefix(key, "kubernetes.io/cluster/"); name != key && cluster == "" {
+				cluster = name
+			}
+		}
+	}
+	if cluster == "" && group == "" {
+		return "", false
+	}
+	if group == "" {
+		group = "self-managed"
+	}
+	return cluster + "/" + group, true
+}
+
+// tagValue returns value of tag with key, if it's set
+func tagValue(tags []types.Tag, key string) (string, bool) {
+	for _, t := range tags {
+		if aws.ToString(t.Key) == key {
+			return aws.ToString(t.Value), true
+		}
+	}
+	return "", false
+}
+
+// countGroup counts instance with key k in group of m, allocating m as needed
+func countGroup(m *map[string]map[Key]int, group string, k Key) {
+	if *m == nil {
+		*m = make(map[string]map[Key]int)
+	}
+	if (*m)[group] == nil {
+		(*m)[group] = make(map[Key]int)
+	}
+	(*m)[group][k]++
+}
+
+// Total returns number of instances reservations apply to
+func (inv *Inventory) Total() int {
+	var n int
+	for _, v := range inv.Running {
+		n += v
+	}
+	return n
+}
+
+// Clone returns deep copy of inventory
+func (inv *Inventory) Clone() *Inventory {
+	out := &Inventory{
+		Running:   make(map[Key]int, len(inv.Running)),
+		Spot:      make(map[Key]int, len(inv.Spot)),
+		Truncated: inv.Truncated,
+	}
+	for k, v := range inv.Running {
+		out.Running[k] = v
+	}
+	for k, v := range inv.Spot {
+		out.Spot[k] = v
+	}
+	out.Tagged = cloneGroups(inv.Tagged)
+	out.AutoScaling = cloneGroups(inv.AutoScaling)
+	out.Kubernetes = cloneGroups(inv.Kubernetes)
+	return out
+}
+
+// cloneGroups returns deep copy of instance counts by group, nil if m is nil
+func cloneGroups(m map[string]map[Key]int) map[string]map[Key]int {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]map[Key]int, len(m))
+	for group, counts := range m {
+		out[group] = make(map[Key]int, len(counts))
+		for k, v := range counts {
+			out[group][k] = v
+		}
+	}
+	return out
+}
+
+// Reservations holds active reservations of a single account and region
+type Reservations struct {
+	AZ          map[Key]int           // AZ-scoped reservations
+	Region      map[Key]int           // Region-scoped reservations matched by type
+	Pools       map[PoolKey]*FlexPool // size-flexible reservations by instance family and platform
+	Convertible map[string]int        // instance type to number of convertible reservations
+	Terms       []Term                // reservations counted by Add, with their end dates
+	Queued      []Term                // purchases queued to start in the future, not counted
+	Listed      []Term                // listed for sale, see Options.Listed
+}
+
+// Term is a number of reservations bought together, ending at the same time
+type Term struct {
+	ID          string
+	Key         Key // AZ is empty for Region-scoped reservations
+	Count       int
+	Start       time.Time
+	End         time.Time
+	Convertible bool
+	Offering    Offering
+}
+
+// NewReservations returns empty Reservations, ready for reservations to be
+// added
+func NewReservations() *Reservations {
+	return &Reservations{
+		AZ:          make(map[Key]int),
+		Region:      make(map[Key]int),
+		Pools:       make(map[PoolKey]*FlexPool),
+		Convertible: make(map[string]int),
+	}
+}
+
+// Add counts reservation according to opts. Queued reservations are not
+// counted, but kept in Queued. Instances listed for sale are kept in Listed,
+// and are not counted with Options.ExcludeListed.
+func (rs *Reservations) Add(r *types.ReservedInstances, opts Options) error {
+	typ, count := string(r.InstanceType), int(aws.ToInt32(r.InstanceCount))
+	if !opts.TypeSelected(typ) {
+		return nil
+	}
+	var platform string
+	if !opts.IgnorePlatform {
+		platform = reservationPlatform(r)
+	}
+	tenancy := reservationTenancy(r)
+	var k Key
+	switch r.Scope {
+	case types.ScopeRegional:
+		k = Key{Type: typ, Platform: platform, Tenancy: tenancy}
+	case types.ScopeAvailabilityZone:
+		az := aws.ToString(r.AvailabilityZone)
+		if !opts.hasAZ(az) {
+			return nil
+		}
+		k = Key{Type: typ, AZ: az, Platform: platform, Tenancy: tenancy}
+	default:
+		return fmt.Errorf("unknown reservation scope: %q", r.Scope)
+	}
+	term := Term{ID: aws.ToString(r.ReservedInstancesId), Key: k, Count: count, Start: aws.ToTime(r.Start), End: aws.ToTime(r.End),
+		Convertible: r.OfferingClass == types.OfferingClassTypeConvertible, Offering: offering(r)}
+	if r.State == types.ReservedInstanceStateQueued {
+		rs.Queued = append(rs.Queued, term)
+		return nil
+	}
+	if n := opts.Listed[term.ID]; n > 0 {
+		if n > count {
+			n = count
+		}
+		listed := term
+		listed.Count = n
+		rs.Listed = append(rs.Listed, listed)
+		if opts.ExcludeListed {
+			if count -= n; count == 0 {
+				return nil
+			}
+			term.Count = count
+		}
+	}
+	if r.OfferingClass == types.OfferingClassTypeConvertible {
+		rs.Convertible[typ] += count
+	}
+	rs.Terms = append(rs.Terms, term)
+	switch {
+	case !opts.StrictTypes && sizeFlexible(r):
+		rs.AddFlexible(typ, platform, count)
+	case k.AZ == "":
+		rs.Region[k] += count
+	default:
+		rs.AZ[k] += count
+	}
+	return nil
+}
+
+// Merge adds reservations of other to rs
+func (rs *Reservations) Merge(other *Reservations) {
+	for k, v := range other.AZ {
+		rs.AZ[k] += v
+	}
+	for k, v := range other.Region {
+		rs.Region[k] += v
+	}
+	for pk, p := range other.Pools {
+		for t := range p.Types {
+			rs.AddFlexible(t, pk.Platform, 0)
+		}
+		rs.Pools[pk].Units += p.Units
+	}
+	for k, v := range other.Convertible {
+		rs.Convertible[k] += v
+	}
+	rs.Terms = append(rs.Terms, other.Terms...)
+	rs.Queued = append(rs.Queued, other.Queued...)
+	rs.Listed = append(rs.Listed, other.Listed...)
+}
+
+// Clone returns deep copy of reservations
+func (rs *Reservations) Clone() *Reservations {
+	out := NewReservations()
+	out.Merge(rs)
+	return out
+}
+
+// earliestTerm returns reservations ending the earliest of ones unused ones
+// with key k may be made of: ones with the same key, and for Region-scoped keys
+// also size-flexible ones of the same family. It returns nil if there are no
+// such reservations with known end date.
+func (rs *Reservations) earliestTerm(k Key) *Term {
+	var term *Term
+	for i, t := range rs.Terms {
+		if t.End.IsZero() || term != nil && !t.End.Before(term.End) {
+			continue
+		}
+		if t.Key == k || k.AZ == "" && t.Key.AZ == "" && Family(t.Key.Type) == Family(k.Type) &&
+			t.Key.Platform == k.Platform && t.Key.Tenancy == k.Tenancy {
+			term = &rs.Terms[i]
+		}
+	}
+	return term
+}
+
+// Result is the outcome of reconciliation
+type Result struct {
+	Running            int    `json:"running"` // total number of instances reservations apply to
+	OnDemandInstances  []Item `json:"onDemandInstances"`
+	UnusedReservations []Item `json:"unusedReservations"`
+	Spot               []Item `json:"spot,omitempty"` // spot instances, only set with Options.Spot
+}
+
+// Uncovered returns total number of on-demand instances
+func (r *Result) Uncovered() int {
+	var n int
+	for _, v := range r.OnDemandInstances {
+		n += v.Count
+	}
+	return n
+}
+
+// Unused returns total number of unused reservations
+func (r *Result) Unused() int {
+	var n int
+	for _, v := range r.UnusedReservations {
+		n += v.Count
+	}
+	return n
+}
+
+// Reconcile applies reservations to instances the way AWS does and reports
+// what's left on either side. Its arguments are not modified.
+func Reconcile(inv *Inventory, rs *Reservations) *Result {
+	inv, rs = inv.Clone(), rs.Clone()
+	res := &Result{Running: inv.Total()}
+	for k, v := range reconcile(inv.Running, rs.AZ, rs.Region, rs.Pools) {
+		switch {
+		case v < 0:
+			res.OnDemandInstances = append(res.OnDemandInstances, k.Uncovered(-v))
+		case v > 0:
+			it := k.Unused(v)
+			if t := rs.earliestTerm(k); t != nil {
+				end, offering := t.End, t.Offering.resize(t.Key.Type, k.Type)
+				it.End, it.Offering = &end, &offering
+			}
+			res.UnusedReservations = append(res.UnusedReservations, it)
+		}
+	}
+	for k, v := range inv.Spot {
+		res.Spot = append(res.Spot, k.Uncovered(v))
+	}
+	sortItems(res.OnDemandInstances)
+	sortItems(res.UnusedReservations)
+	sortItems(res.Spot)
+	return res
+}
+
+// sortItems sorts items by type, then AZ, platform and tenancy, so that
+// output is stable
+func sortItems(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.AZ != b.AZ {
+			return a.AZ < b.AZ
+		}
+		if a.Platform != b.Platform {
+			return a.Platform < b.Platform
+		}
+		return a.Tenancy < b.Tenancy
+	})
+}
+
+// Family returns family part of instance type, i.e. "m5" for "m5.large", or
+// "db.r5" for "db.r5.large"
+func Family(typ string) string {
+	if i := strings.LastIndexByte(typ, '.'); i > 0 {
+		return typ[:i]
+	}
+	return typ
+}
+
+// algorithm:
+// 1. fetch all reserved instances info, put them into 2 maps: one for AZ-scoped
+// reservations, one for Region-scoped reservations. Key of map is a struct,
+// value is number of instances.
+// 2. fetch all running instances info
+// 3. for each running instance info decrease number in AZ-scoped reservations,
+// so that final form of AZ-scoped reservations would contain positive values
+// for unused reservations, and negative values for running instances w/o
+// reservations.
+// 4. iterate over k/v pairs with NEGATIVE values in AZ-scoped map, try to add
+// values from Region-scoped reservations map.
+// 5. spend size-flexible Region-scoped reservations pooled per instance family
+// in normalized units on what's still NEGATIVE, see applyFlexPools.
+
+func reconcile(runningInstances, azReservations, regionReservations map[Key]int, pools map[PoolKey]*FlexPool) map[Key]int {
+	out := make(map[Key]int, len(runningInstances))
+	for k, v := range runningInstances {
+		out[k] = -v
+	}
+	for k, v := range azReservations {
+		out[k] += v
+	}
+	for k, v := range out {
+		if v >= 0 { // only process items that really lacks reservations
+			continue
+		}
+		k2 := Key{Type: k.Type, Platform: k.Platform, Tenancy: k.Tenancy}
+		if v2, ok := regionReservations[k2]; ok {
+			need, have := -v, v2
+			switch {
+			case need >= have:
+				out[k] = v + v2
+				delete(regionReservations, k2)
+			default:
+				out[k] += need
+				regionReservations[k2] -= need
+			}
+		}
+	}
+	for k, v := range regionReservations {
+		out[k] += v
+	}
+	applyFlexPools(out, pools)
+	return out
+}
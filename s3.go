@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// formatExtensions maps report format to file name extension
+var formatExtensions = map[string]string{
+	"text":     ".txt",
+	"json":     ".json",
+	"csv":      ".csv",
+	"markdown": ".md",
+	"html":     ".html",
+}
+
+// formatContentTypes maps report format to MIME type
+var formatContentTypes = map[string]string{
+	"text":     "text/plain; charset=utf-8",
+	"json":     "application/json",
+	"csv":      "text/csv; charset=utf-8",
+	"markdown": "text/markdown; charset=utf-8",
+	"html":     "text/html; charset=utf-8",
+}
+
+// uploadReport uploads rendered report to S3 location set by cfg.S3. If
+// location ends with slash, key is generated from report time and format.
+func uploadReport(ctx context.Context, cfg config, t time.Time, body []byte) error {
+	u, err := url.Parse(cfg.S3)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return fmt.Errorf("invalid S3 URL %q, must be s3://bucket/key", cfg.S3)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "ec2-reservations-" + t.UTC().Format("20060102T150405Z") + formatExtensions[cfg.Format]
+	}
+	awsCfg, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	// LocalStack and the like address buckets by path
+	svc := s3.NewFromConfig(awsCfg, func(o *s3.Options) { o.UsePathStyle = cfg.EndpointURL != "" })
+	_, err = svc.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(u.Host),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(formatContentTypes[cfg.Format]),
+	})
+	return err
+}
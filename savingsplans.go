@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/costexplorer"
+	cetypes "github.com/aws/aws-sdk-go-v2/service/costexplorer/types"
+	"github.com/aws/aws-sdk-go-v2/service/savingsplans"
+	sptypes "github.com/aws/aws-sdk-go-v2/service/savingsplans/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// ceAttr returns group attribute by dimension name; Cost Explorer APIs are
+// not consistent in attribute key case, i.e. REGION vs region, and
+// INSTANCE_TYPE_FAMILY vs instanceTypeFamily
+func ceAttr(attrs map[string]string, name string) string {
+	norm := func(s string) string { return strings.ToLower(strings.ReplaceAll(s, "_", "")) }
+	for k, v := range attrs {
+		if norm(k) == norm(name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// fetchSavingsPlansCoverage returns percentage of EC2 spend not covered by
+// reservations that Savings Plans cover over the last days, per region and
+// instance family
+func fetchSavingsPlansCoverage(ctx context.Context, awsCfg aws.Config, days int) (map[[2]string]float64, error) {
+	input := &costexplorer.GetSavingsPlansCoverageInput{
+		TimePeriod: ceTimePeriod(days),
+		GroupBy: []cetypes.GroupDefinition{
+			{Type: cetypes.GroupDefinitionTypeDimension, Key: aws.String("REGION")},
+			{Type: cetypes.GroupDefinitionTypeDimension, Key: aws.String("INSTANCE_TYPE_FAMILY")},
+		},
+		Filter: &cetypes.Expression{Dimensions: &cetypes.DimensionValues{
+			Key:    cetypes.DimensionService,
+			Values: []string{ceService},
+		}},
+	}
+	svc := newCostExplorer(awsCfg)
+	spend := make(map[[2]string][2]float64) // covered and on-demand spend
+	for {
+		page, err := svc.GetSavingsPlansCoverage(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.SavingsPlansCoverages {
+			if c.Coverage == nil {
+				continue
+			}
+			k := [2]string{ceAttr(c.Attributes, "REGION"), ceAttr(c.Attributes, "INSTANCE_TYPE_FAMILY")}
+			var covered, onDemand float64
+			fmt.Sscan(aws.ToString(c.Coverage.SpendCoveredBySavingsPlans), &covered)
+			fmt.Sscan(aws.ToString(c.Coverage.OnDemandCost), &onDemand)
+			v := spend[k]
+			spend[k] = [2]float64{v[0] + covered, v[1] + onDemand}
+		}
+		if aws.ToString(page.NextToken) == "" {
+			break
+		}
+		input.NextToken = page.NextToken
+	}
+	out := make(map[[2]string]float64, len(spend))
+	for k, v := range spend {
+		if total := v[0] + v[1]; total > 0 {
+			out[k] = v[0] / total * 100
+		}
+	}
+	return out, nil
+}
+
+// annotateSavingsPlans sets estimated number of on-demand instances covered by
+// Savings Plans in reports. Savings Plans apply to spend rather than to
+// particular instances, so on-demand instances of a family are assumed to be
+// covered in the same proportion as the family spend was over the last days.
+func annotateSavingsPlans(ctx context.Context, awsCfg aws.Config, days int, reps []*report) error {
+	coverage, err := fetchSavingsPlansCoverage(ctx, awsCfg, days)
+	if err != nil {
+		return err
+	}
+	for _, rep := range reps {
+		for i := range rep.OnDemandInstances {
+			v := &rep.OnDemandInstances[i]
+			pct := coverage[[2]string{rep.Region, reservations.Family(v.Type)}]
+			v.SavingsPlans = int(math.Round(float64(v.Count) * pct / 100))
+		}
+	}
+	return nil
+}
+
+// savingsPlansCovered returns estimated number of on-demand instances covered
+// by Savings Plans
+func (r *report) savingsPlansCovered() int {
+	var n int
+	for _, v := range r.OnDemandInstances {
+		n += v.SavingsPlans
+	}
+	return n
+}
+
+// savingsPlansNote returns tab-prefixed human-readable number of on-demand
+// instances covered by Savings Plans, or empty string if there are none
+func savingsPlansNote(v reservations.Item) string {
+	if v.SavingsPlans == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\t~%d covered by Savings Plans", v.SavingsPlans)
+}
+
+// savingsPlan is an active EC2 or Compute Savings Plan
+type savingsPlan struct {
+	Account    string  `json:"account,omitempty"`
+	ID         string  `json:"id"`
+	Type       string  `json:"type"`             // Compute or EC2Instance
+	Region     string  `json:"region,omitempty"` // only set for EC2 Instance Savings Plans
+	Family     string  `json:"family,omitempty"` // only set for EC2 Instance Savings Plans
+	Commitment float64 `json:"commitment"`       // per hour
+	End        string  `json:"end"`
+}
+
+// savingsPlansUsage is Savings Plans commitment and its utilization
+type savingsPlansUsage struct {
+	Plans []savingsPlan `json:"plans,omitempty"`
+	// totals over the last -lookback-days days, from Cost Explorer
+	Commitment  float64 `json:"commitment"`
+	Used        float64 `json:"used"`
+	Unused      float64 `json:"unused"`
+	Utilization float64 `json:"utilization"` // percentage of commitment used
+	NetSavings  float64 `json:"netSavings"`  // compared to on-demand prices
+}
+
+// fetchSavingsPlans returns active Compute and EC2 Instance Savings Plans
+// owned by account of awsCfg
+func fetchSavingsPlans(ctx context.Context, awsCfg aws.Config, account string) ([]savingsPlan, error) {
+	// Savings Plans API is global and served from the same region as Cost
+	// Explorer one
+	svc := savingsplans.NewFromConfig(awsCfg, func(o *savingsplans.Options) { o.Region = ceRegion })
+	input := &savingsplans.DescribeSavingsPlansInput{
+		States: []sptypes.SavingsPlanState{sptypes.SavingsPlanStateActive},
+	}
+	var out []savingsPlan
+	for {
+		page, err := svc.DescribeSavingsPlans(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.SavingsPlans {
+			switch p.SavingsPlanType {
+			case sptypes.SavingsPlanTypeCompute, sptypes.SavingsPlanTypeEc2Instance:
+			default:
+				continue
+			}
+			sp := savingsPlan{
+				Account: account,
+				ID:      aws.ToString(p.SavingsPlanId),
+				Type:    string(p.SavingsPlanType),
+				Region:  aws.ToString(p.Region),
+				Family:  aws.ToString(p.Ec2InstanceFamily),
+				End:     aws.ToString(p.End),
+			}
+			fmt.Sscan(aws.ToString(p.Commitment), &sp.Commitment)
+			out = append(out, sp)
+		}
+		if aws.ToString(page.NextToken) == "" {
+			return out, nil
+		}
+		input.NextToken = page.NextToken
+	}
+}
+
+// fetchSavingsPlansUsage returns active Savings Plans of accounts of reports
+// and their utilization over the last days. Utilization is not split per
+// account, it covers all accounts Cost Explorer of awsCfg has data on.
+func fetchSavingsPlansUsage(ctx context.Context, awsCfg aws.Config, days int, reps []*report) (*savingsPlansUsage, error) {
+	usage := new(savingsPlansUsage)
+	seen := make(map[string]bool)
+	for _, rep := range reps {
+		if seen[rep.Account] {
+			continue
+		}
+		seen[rep.Account] = true
+		plans, err := fetchSavingsPlans(ctx, rep.awsCfg, rep.Account)
+		if err != nil {
+			return nil, err
+		}
+		usage.Plans = append(usage.Plans, plans...)
+	}
+	out, err := newCostExplorer(awsCfg).GetSavingsPlansUtilization(ctx, &costexplorer.GetSavingsPlansUtilizationInput{
+		TimePeriod: ceTimePeriod(days),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if t := out.Total; t != nil {
+		if u := t.Utilization; u != nil {
+			fmt.Sscan(aws.ToString(u.TotalCommitment), &usage.Commitment)
+			fmt.Sscan(aws.ToString(u.UsedCommitment), &usage.Used)
+			fmt.Sscan(aws.ToString(u.UnusedCommitment), &usage.Unused)
+			fmt.Sscan(aws.ToString(u.UtilizationPercentage), &usage.Utilization)
+		}
+		if s := t.Savings; s != nil {
+			fmt.Sscan(aws.ToString(s.NetSavings), &usage.NetSavings)
+		}
+	}
+	return usage, nil
+}
+
+func writeSavingsPlans(w io.Writer, usage *savingsPlansUsage) {
+	if usage == nil || (len(usage.Plans) == 0 && usage.Commitment == 0) {
+		return
+	}
+	fmt.Fprintln(w, "Savings Plans:")
+	for _, p := range usage.Plans {
+		scope := "any region"
+		if p.Family != "" {
+			scope = p.Family + " in " + p.Region
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t$%g/hour\tuntil %s\n", p.ID, p.Type, scope, p.Commitment, p.End)
+	}
+	fmt.Fprintf(w, "Commitment $%.2f, used $%.2f, unused $%.2f (%g%% utilization), net savings $%.2f\n",
+		usage.Commitment, usage.Used, usage.Unused, usage.Utilization, usage.NetSavings)
+}
+
+// savingsPlanComparison compares Cost Explorer recommendation of a Compute
+// Savings Plan with its recommendation of reservations, both based on the
+// same usage history
+type savingsPlanComparison struct {
+	Commitment         float64 `json:"commitment"`         // recommended hourly commitment
+	Savings            float64 `json:"savings"`            // per month, with the Savings Plan
+	ReservationSavings float64 `json:"reservationSavings"` // per month, with recommended reservations
+	Currency           string  `json:"currency,omitempty"`
+}
+
+// fetchSavingsPlanRecommendation returns Cost Explorer recommendation of 1 year
+// no upfront Compute Savings Plan based on usage of the last days, with
+// savings of reservations ris it's compared with. With payer set
+// recommendation is made for the whole organization, otherwise for the
+// account of awsCfg.
+func fetchSavingsPlanRecommendation(ctx context.Context, awsCfg aws.Config, days int, payer bool, ris []purchase) (*savingsPlanComparison, error) {
+	period, err := lookbackPeriod(days)
+	if err != nil {
+		return nil, err
+	}
+	input := &costexplorer.GetSavingsPlansPurchaseRecommendationInput{
+		SavingsPlansType:     cetypes.SupportedSavingsPlansTypeComputeSp,
+		AccountScope:         cetypes.AccountScopeLinked,
+		LookbackPeriodInDays: period,
+		PaymentOption:        cetypes.PaymentOptionNoUpfront,
+		TermInYears:          cetypes.TermInYearsOneYear,
+	}
+	if payer {
+		input.AccountScope = cetypes.AccountScopePayer
+	}
+	out, err := newCostExplorer(awsCfg).GetSavingsPlansPurchaseRecommendation(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	c := new(savingsPlanComparison)
+	if r := out.SavingsPlansPurchaseRecommendation; r != nil && r.SavingsPlansPurchaseRecommendationSummary != nil {
+		s := r.SavingsPlansPurchaseRecommendationSummary
+		fmt.Sscan(aws.ToString(s.HourlyCommitmentToPurchase), &c.Commitment)
+		fmt.Sscan(aws.ToString(s.EstimatedMonthlySavingsAmount), &c.Savings)
+		c.Currency = aws.ToString(s.CurrencyCode)
+	}
+	for _, p := range ris {
+		// savings are formatted as amount followed by currency
+		var v float64
+		fmt.Sscan(p.Savings, &v)
+		c.ReservationSavings += v
+	}
+	return c, nil
+}
+
+func writeSavingsPlanComparison(w io.Writer, c *savingsPlanComparison) {
+	if c == nil {
+		return
+	}
+	if c.Commitment == 0 {
+		fmt.Fprintln(w, "Cost Explorer doesn't recommend a Compute Savings Plan.")
+		return
+	}
+	fmt.Fprintf(w, "Compute Savings Plan (1 year, no upfront): commit %g %s/hour, saves %.2f %s/month\n",
+		c.Commitment, c.Currency, c.Savings, c.Currency)
+	better := "Savings Plan"
+	if c.ReservationSavings > c.Savings {
+		better = "reservations"
+	}
+	fmt.Fprintf(w, "Reservations recommended by Cost Explorer save %.2f %s/month, %s save more\n",
+		c.ReservationSavings, c.Currency, better)
+}
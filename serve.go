@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// serve runs HTTP server exposing reconciliation results as Prometheus
+// metrics and as report in any supported format, refreshing them every
+// cfg.Interval. Server is shut down once ctx is canceled.
+func serve(ctx context.Context, cfg config) error {
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("refresh interval must be positive")
+	}
+	var mu sync.RWMutex
+	var res *result
+	var lastErr error
+	refresh := func() {
+		ctx, cancel := cfg.withTimeout(ctx)
+		defer cancel()
+		r, err := collect(ctx, cfg)
+		if err != nil {
+			log.Print("refresh: ", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if lastErr = err; err == nil {
+			res = r
+		}
+	}
+	refresh()
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		defer mu.RUnlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, res, lastErr == nil)
+	})
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "text"
+		}
+		ctype, ok := formatContentTypes[format]
+		if !ok {
+			http.Error(w, "unsupported format", http.StatusBadRequest)
+			return
+		}
+		mu.RLock()
+		defer mu.RUnlock()
+		if res == nil {
+			http.Error(w, "no data yet", http.StatusServiceUnavailable)
+			return
+		}
+		var buf bytes.Buffer
+		if err := writeFormat(&buf, format, res); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Last-Modified", res.Time.Format(http.TimeFormat))
+		w.Write(buf.Bytes())
+	})
+	srv := &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      mux,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// writeMetrics writes result in Prometheus text exposition format; res may be
+// nil if no refresh has succeeded yet
+func writeMetrics(w io.Writer, res *result, ok bool) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP ec2_reservations_up Whether the last refresh succeeded.")
+	fmt.Fprintln(bw, "# TYPE ec2_reservations_up gauge")
+	if ok {
+		fmt.Fprintln(bw, "ec2_reservations_up 1")
+	} else {
+		fmt.Fprintln(bw, "ec2_reservations_up 0")
+	}
+	if res == nil {
+		return bw.Flush()
+	}
+	fmt.Fprintln(bw, "# HELP ec2_reservations_last_refresh_timestamp_seconds Time of the last successful refresh.")
+	fmt.Fprintln(bw, "# TYPE ec2_reservations_last_refresh_timestamp_seconds gauge")
+	fmt.Fprintf(bw, "ec2_reservations_last_refresh_timestamp_seconds %d\n", res.Time.Unix())
+
+	fmt.Fprintln(bw, "# HELP ec2_reservations_running_instances Number of running instances inspected.")
+	fmt.Fprintln(bw, "# TYPE ec2_reservations_running_instances gauge")
+	for _, rep := range res.Reports {
+		fmt.Fprintf(bw, "ec2_reservations_running_instances{%s} %d\n", reportLabels(rep), rep.Running)
+	}
+	fmt.Fprintln(bw, "# HELP ec2_reservations_uncovered_instances Number of running instances not covered by reservations.")
+	fmt.Fprintln(bw, "# TYPE ec2_reservations_uncovered_instances gauge")
+	for _, rep := range res.Reports {
+		for _, v := range rep.OnDemandInstances {
+			fmt.Fprintf(bw, "ec2_reservations_uncovered_instances{%s,type=%s,az=%s,platform=%s,tenancy=%s} %d\n",
+				reportLabels(rep), strconv.Quote(v.Type), strconv.Quote(v.AZ),
+				strconv.Quote(v.Platform), strconv.Quote(v.Tenancy), v.Count)
+		}
+	}
+	fmt.Fprintln(bw, "# HELP ec2_reservations_unused Number of unused reserved instances.")
+	fmt.Fprintln(bw, "# TYPE ec2_reservations_unused gauge")
+	for _, rep := range res.Reports {
+		for _, v := range rep.UnusedReservations {
+			fmt.Fprintf(bw, "ec2_reservations_unused{%s,type=%s,scope=%s,az=%s,platform=%s,tenancy=%s} %d\n",
+				reportLabels(rep), strconv.Quote(v.Type), strconv.Quote(v.Scope), strconv.Quote(v.AZ),
+				strconv.Quote(v.Platform), strconv.Quote(v.Tenancy), v.Count)
+		}
+	}
+	return bw.Flush()
+}
+
+// reportLabels returns metric labels identifying report: its service, account
+// and region
+func reportLabels(rep *report) string {
+	return fmt.Sprintf("service=%s,account=%s,region=%s",
+		strconv.Quote(rep.service()), strconv.Quote(rep.Account), strconv.Quote(rep.Region))
+}
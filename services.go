@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// service is AWS service other than EC2 whose reservations are reconciled
+// with -service flag. Its instances and reservations are counted into the
+// same Inventory and Reservations EC2 ones are, with instance class (node
+// type) as Key.Type and engine as Key.Platform.
+type service struct {
+	resource string // what is reserved, i.e. "RDS DB instances"
+	fetch    func(ctx context.Context, account string, awsCfg aws.Config, cfg config, prog *progress) (*reservations.Inventory, *reservations.Reservations, error)
+}
+
+// services are supported values of -service flag, in addition to ec2
+var services = map[string]service{
+	"rds":         {resource: "RDS DB instances", fetch: fetchRDS},
+	"elasticache": {resource: "ElastiCache nodes", fetch: fetchElastiCache},
+	"redshift":    {resource: "Redshift nodes", fetch: fetchRedshift},
+	"opensearch":  {resource: "OpenSearch instances", fetch: fetchOpenSearch},
+	"dynamodb":    {resource: "DynamoDB capacity units", fetch: fetchDynamoDB},
+	"memorydb":    {resource: "MemoryDB nodes", fetch: fetchMemoryDB},
+}
+
+// serviceTitle returns human-readable name of service, i.e. ElastiCache for
+// elasticache, EC2 for ec2 or empty name
+func serviceTitle(name string) string {
+	if s, ok := services[name]; ok {
+		return strings.Fields(s.resource)[0]
+	}
+	return "EC2"
+}
+
+// allServices is -service value selecting EC2 and all services
+const allServices = "all"
+
+// serviceNames returns ec2 followed by names of services in alphabetical
+// order, which is the order reports are grouped in with -service all
+func serviceNames() []string {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{"ec2"}, names...)
+}
+
+// serviceRank returns position of service in serviceNames, EC2 reports of
+// single-service runs have empty service
+func serviceRank(name string) int {
+	for i, s := range serviceNames() {
+		if s == name {
+			return i
+		}
+	}
+	return 0
+}
+
+// checkService reports an error if cfg selects unknown service, or sets flags
+// only supported for EC2 together with another service. With -service all,
+// flags selecting EC2 instances are allowed and only apply to EC2.
+func (cfg config) checkService() error {
+	if len(cfg.DynamoDBReserved) > 0 && cfg.Service != "dynamodb" && cfg.Service != allServices {
+		return errors.New("-dynamodb-reserved is only supported with -service dynamodb or all")
+	}
+	if cfg.Service == "ec2" || cfg.Service == "" {
+		return nil
+	}
+	if _, ok := services[cfg.Service]; !ok && cfg.Service != allServices {
+		return fmt.Errorf("unknown -service %q", cfg.Service)
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+		all  bool // allowed with -service all
+	}{
+		{"-az", len(cfg.AZs) > 0, true},
+		{"-filter", len(cfg.Filters) > 0, true},
+		{"-tag", len(cfg.Tags) > 0, true},
+		{"-exclude-tag", len(cfg.ExcludeTags) > 0, true},
+		{"-instance-ids", len(cfg.InstanceIDs) > 0, true},
+		{"-owner-id", len(cfg.OwnerIDs) > 0, true},
+		{"-requester-id", len(cfg.RequesterIDs) > 0, true},
+		{"-include-spot", cfg.IncludeSpot, true},
+		{"-spot", cfg.Spot, true},
+		{"-modifications", cfg.Modifications, true},
+		{"-capacity-reservations", cfg.CapacityReservations, true},
+		{"-dedicated-hosts", cfg.DedicatedHosts, true},
+		{"-expiring-within", cfg.ExpiringWithin > 0, true},
+		{"-listings", cfg.Listings, true},
+		{"-exclude-listed", cfg.ExcludeListed, true},
+		{"-recommend", cfg.Recommend, true},
+		{"-exchange-quotes", cfg.ExchangeQuotes, true},
+		{"-modify-commands", cfg.ModifyCommands, true},
+		{"-costs", cfg.Costs, true},
+		{"-group-by tag", cfg.groupTag() != "", true},
+		{"-asgs", cfg.ASGs, true},
+		{"-eks", cfg.EKS, true},
+		{"-record", cfg.Record != "", false},
+		{"-replay", cfg.Replay != "", false},
+		{"-instances-file", cfg.InstancesFile != "", false},
+		{"-cost-explorer", cfg.CostExplorer, false},
+		{"-savings-plans", cfg.SavingsPlans, false},
+		{"simulate command", len(cfg.Changes) > 0, false},
+	} {
+		if f.set && (cfg.Service != allServices || !f.all) {
+			return fmt.Errorf("%s is only supported with -service ec2", f.name)
+		}
+	}
+	return nil
+}
+
+// serviceJobs returns jobs inspecting every service for each of jobs, grouped
+// by service
+func serviceJobs(jobs []job) []job {
+	var out []job
+	for _, name := range serviceNames() {
+		for _, j := range jobs {
+			j.service = name
+			out = append(out, j)
+		}
+	}
+	return out
+}
+
+// inspectService makes report on reservations of service in account (empty
+// for the account of base config) and region of awsCfg
+func inspectService(ctx context.Context, name, account string, awsCfg aws.Config, cfg config, prog *progress) (*report, error) {
+	inv, ris, err := services[name].fetch(ctx, account, awsCfg, cfg, prog)
+	if err != nil {
+		return nil, err
+	}
+	rep := &report{Service: name, Region: awsCfg.Region, inv: inv, ris: ris}
+	rep.reconcile(cfg)
+	return rep, nil
+}
+
+// resource returns what report reservations are for, i.e. "EC2 instances"
+func (r *report) resource() string {
+	if s, ok := services[r.Service]; ok {
+		return s.resource
+	}
+	return "EC2 instances"
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// change is a hypothetical change of instances or reservations applied on
+// top of fetched data by simulate command
+type change struct {
+	Count       int    // positive to add, negative to remove
+	Type        string // instance type
+	Location    string // AZ or region, may be empty for Region-scoped reservations
+	Reservation bool   // change applies to reservations rather than instances
+	text        string // original change
+}
+
+// parseChange parses change in the form "add|remove N TYPE [in AZ|REGION]
+// [RI|RIs]", i.e. "add 10 m5.xlarge in us-east-1a" or "remove 4 c5.large
+// RIs". Instance changes require AZ; reservations with AZ are AZ-scoped, ones
+// with region or without location are Region-scoped.
+func parseChange(s string) (change, error) {
+	c := change{text: s}
+	fields := strings.Fields(s)
+	if n := len(fields); n > 0 {
+		switch strings.ToLower(fields[n-1]) {
+		case "ri", "ris", "reservation", "reservations":
+			c.Reservation = true
+			fields = fields[:n-1]
+		}
+	}
+	if n := len(fields); n == 5 && fields[3] == "in" {
+		c.Location = fields[4]
+		fields = fields[:3]
+	}
+	if len(fields) != 3 {
+		return c, fmt.Errorf("invalid change %q, must be in \"add|remove N TYPE [in AZ] [RIs]\" form", s)
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n <= 0 {
+		return c, fmt.Errorf("invalid count in change %q", s)
+	}
+	switch fields[0] {
+	case "add":
+		c.Count = n
+	case "remove":
+		c.Count = -n
+	default:
+		return c, fmt.Errorf("invalid change %q, must start with add or remove", s)
+	}
+	if c.Type = fields[2]; !strings.Contains(c.Type, ".") {
+		return c, fmt.Errorf("invalid instance type in change %q", s)
+	}
+	if !c.Reservation && !isAZ(c.Location) {
+		return c, fmt.Errorf("change %q must set availability zone of instances, i.e. in us-east-1a", s)
+	}
+	return c, nil
+}
+
+// isAZ reports whether s looks like AZ name rather than region name, i.e.
+// us-east-1a vs us-east-1
+func isAZ(s string) bool {
+	return s != "" && s[len(s)-1] >= 'a' && s[len(s)-1] <= 'z'
+}
+
+// region returns region of change, or empty string if it's not set
+func (c change) region() string {
+	if isAZ(c.Location) {
+		return c.Location[:len(c.Location)-1]
+	}
+	return c.Location
+}
+
+// applyChanges applies changes to inventory and reservations of reports and
+// reconciles them again. Change applies to a report of its region; change
+// without region requires a single region being inspected. Each change must
+// match reports of a single account.
+func applyChanges(cfg config, reports []*report) error {
+	opts := cfg.options()
+	for _, c := range cfg.Changes {
+		var matched []*report
+		for _, rep := range reports {
+			if c.region() == "" || rep.Region == c.region() {
+				matched = append(matched, rep)
+			}
+		}
+		switch {
+		case len(matched) == 0:
+			return fmt.Errorf("change %q doesn't match any inspected region", c.text)
+		case len(matched) > 1 && c.region() == "":
+			return fmt.Errorf("change %q matches several regions, set one with \"in REGION\"", c.text)
+		case len(matched) > 1:
+			return fmt.Errorf("change %q matches several accounts, select one with -accounts", c.text)
+		}
+		if err := c.apply(matched[0], opts); err != nil {
+			return fmt.Errorf("change %q: %w", c.text, err)
+		}
+	}
+	for _, rep := range reports {
+		rep.reconcile(cfg)
+	}
+	return nil
+}
+
+// errExcluded is returned for changes of instances or reservations that are
+// not inspected at all
+var errExcluded = errors.New("excluded by -types, -exclude-types or -az")
+
+// apply applies change to report inventory or reservations. Simulated
+// instances and reservations are Linux/UNIX ones with default tenancy.
+func (c change) apply(rep *report, opts reservations.Options) error {
+	if !c.Reservation {
+		delta := reservations.NewInventory()
+		inst := &types.Instance{
+			InstanceType:    types.InstanceType(c.Type),
+			Placement:       &types.Placement{AvailabilityZone: aws.String(c.Location)},
+			PlatformDetails: aws.String(reservations.LinuxPlatform),
+		}
+		delta.Add(inst, opts)
+		if len(delta.Running) == 0 {
+			return errExcluded
+		}
+		for k := range delta.Running {
+			if rep.inv.Running[k]+c.Count < 0 {
+				return fmt.Errorf("only %d such instances running", rep.inv.Running[k])
+			}
+			if rep.inv.Running[k] += c.Count; rep.inv.Running[k] == 0 {
+				delete(rep.inv.Running, k)
+			}
+		}
+		return nil
+	}
+	r := &types.ReservedInstances{
+		InstanceType:       types.InstanceType(c.Type),
+		InstanceCount:      aws.Int32(int32(c.Count)),
+		Scope:              types.ScopeRegional,
+		ProductDescription: reservations.LinuxPlatform,
+		InstanceTenancy:    types.TenancyDefault,
+	}
+	if isAZ(c.Location) {
+		r.Scope = types.ScopeAvailabilityZone
+		r.AvailabilityZone = aws.String(c.Location)
+	}
+	delta := reservations.NewReservations()
+	if err := delta.Add(r, opts); err != nil {
+		return err
+	}
+	if len(delta.AZ)+len(delta.Region)+len(delta.Pools) == 0 {
+		return errExcluded
+	}
+	ris := rep.ris.Clone()
+	ris.Merge(delta)
+	for _, m := range []map[reservations.Key]int{ris.AZ, ris.Region} {
+		for k, v := range m {
+			if v < 0 {
+				return errors.New("can't remove more reservations than there are")
+			}
+			if v == 0 {
+				delete(m, k)
+			}
+		}
+	}
+	for _, p := range ris.Pools {
+		if p.Units < 0 {
+			return errors.New("can't remove more reservations than there are")
+		}
+	}
+	rep.ris = ris
+	return nil
+}
+
+// simulate writes report made with hypothetical changes given as args applied
+// on top of fetched data. Report is written to stdout in format set by cfg,
+// events, notifications and metrics are not sent.
+func simulate(ctx context.Context, cfg config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("simulate requires at least one change, i.e. \"add 10 m5.xlarge in us-east-1a\"")
+	}
+	for _, s := range args {
+		c, err := parseChange(s)
+		if err != nil {
+			return err
+		}
+		cfg.Changes = append(cfg.Changes, c)
+	}
+	ctx, cancel := cfg.withTimeout(ctx)
+	defer cancel()
+	res, err := collect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	return writeFormat(os.Stdout, cfg.Format, res)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// publishReport publishes rendered report to SNS topic
+func publishReport(ctx context.Context, cfg config, body []byte) error {
+	// arn:aws:sns:us-east-1:123456789012:topic
+	fields := strings.SplitN(cfg.SNSTopic, ":", 6)
+	if len(fields) != 6 || fields[2] != "sns" || fields[3] == "" {
+		return fmt.Errorf("invalid SNS topic ARN: %q", cfg.SNSTopic)
+	}
+	awsCfg, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	svc := sns.NewFromConfig(awsCfg, func(o *sns.Options) { o.Region = fields[3] })
+	_, err = svc.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(cfg.SNSTopic),
+		Subject:  aws.String("EC2 reservations mismatch"),
+		Message:  aws.String(string(body)),
+	})
+	return err
+}
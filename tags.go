@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// groupByTagPrefix starts -group-by value splitting uncovered instances by
+// tag, i.e. tag:Team
+const groupByTagPrefix = "tag:"
+
+// groupTag returns tag key set with -group-by, if any
+func (cfg config) groupTag() string {
+	if strings.HasPrefix(cfg.GroupBy, groupByTagPrefix) {
+		return strings.TrimPrefix(cfg.GroupBy, groupByTagPrefix)
+	}
+	return ""
+}
+
+// tagReport is the share of report's on-demand instances attributed to
+// instances having the same tag value
+type tagReport struct {
+	Value             string              `json:"value"` // empty for instances without tag
+	Running           int                 `json:"running"`
+	OnDemand          int                 `json:"onDemand"`
+	Coverage          float64             `json:"coverage"` // percent of running instances
+	OnDemandInstances []reservations.Item `json:"onDemandInstances,omitempty"`
+	Cost              float64             `json:"monthlyCost,omitempty"` // only set with -costs
+}
+
+// splitByTag sets sub-reports of EC2 reports in res per value of key tag.
+// Reservations apply to instances regardless of their tags, so on-demand
+// instances of each type, zone, platform and tenancy are attributed to tag
+// values in proportion to the number of running instances having them.
+func (res *result) splitByTag(key string) {
+	res.split(func(inv *reservations.Inventory) map[string]map[reservations.Key]int { return inv.Tagged },
+		func(rep *report, trs []tagReport) { rep.TagKey, rep.ByTag = key, trs })
+}
+
+// split attributes on-demand instances of reports in res to groups of
+// instances picked from inventory, see splitReport, and sets result with
+// set. Running instances of aggregated reports are counted over all reports
+// in res of the same service and region.
+func (res *result) split(pick func(*reservations.Inventory) map[string]map[reservations.Key]int, set func(*report, []tagReport)) {
+	for _, rep := range res.Reports {
+		if rep.inv != nil {
+			set(rep, splitReport(rep, rep.inv.Running, pick(rep.inv)))
+		}
+	}
+	for _, rep := range res.Aggregated {
+		running := make(map[reservations.Key]int)
+		groups := make(map[string]map[reservations.Key]int)
+		for _, r := range res.Reports {
+			if r.Service != rep.Service || r.Region != rep.Region || r.inv == nil {
+				continue
+			}
+			for k, n := range r.inv.Running {
+				running[k] += n
+			}
+			for v, m := range pick(r.inv) {
+				if groups[v] == nil {
+					groups[v] = make(map[reservations.Key]int)
+				}
+				for k, n := range m {
+					groups[v][k] += n
+				}
+			}
+		}
+		set(rep, splitReport(rep, running, groups))
+	}
+}
+
+// splitReport attributes on-demand instances of rep to tag values. Running
+// instances not in tagged (i.e. added by simulate command) are counted as
+// untagged.
+func splitReport(rep *report, running map[reservations.Key]int, tagged map[string]map[reservations.Key]int) []tagReport {
+	if rep.Service != "" && rep.Service != "ec2" {
+		return nil
+	}
+	byValue := make(map[string]*tagReport)
+	get := func(v string) *tagReport {
+		if byValue[v] == nil {
+			byValue[v] = &tagReport{Value: v}
+		}
+		return byValue[v]
+	}
+	counts := func(k reservations.Key) map[string]int {
+		out := make(map[string]int)
+		var n int
+		for v, m := range tagged {
+			if m[k] > 0 {
+				out[v] = m[k]
+				n += m[k]
+			}
+		}
+		if running[k] > n {
+			out[""] += running[k] - n
+		}
+		return out
+	}
+	for k := range running {
+		for v, c := range counts(k) {
+			get(v).Running += c
+		}
+	}
+	for _, it := range rep.OnDemandInstances {
+		n := it.Count - it.SavingsPlans
+		if n <= 0 {
+			continue
+		}
+		for v, c := range apportion(n, counts(it.Key())) {
+			t := get(v)
+			share := it
+			share.Count, share.SavingsPlans = c, 0
+			t.OnDemand += c
+			t.OnDemandInstances = append(t.OnDemandInstances, share)
+			t.Cost += it.OnDemandRate * hoursPerMonth * float64(c)
+		}
+	}
+	out := make([]tagReport, 0, len(byValue))
+	for _, t := range byValue {
+		t.Cost = roundCents(t.Cost)
+		t.Coverage = percent(t.Running-t.OnDemand, t.Running, 1)
+		sort.Slice(t.OnDemandInstances, func(i, j int) bool { return t.OnDemandInstances[i].Type < t.OnDemandInstances[j].Type })
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].OnDemand != out[j].OnDemand {
+			return out[i].OnDemand > out[j].OnDemand
+		}
+		return out[i].Value < out[j].Value
+	})
+	return out
+}
+
+// apportion splits n in proportion to weights using largest remainder
+// method; ties go to values sorting first
+func apportion(n int, weights map[string]int) map[string]int {
+	var total int
+	values := make([]string, 0, len(weights))
+	for v, w := range weights {
+		total += w
+		values = append(values, v)
+	}
+	out := make(map[string]int)
+	if total == 0 {
+		out[""] = n
+		return out
+	}
+	sort.Strings(values)
+	rem := make(map[string]int)
+	left := n
+	for _, v := range values {
+		out[v] = n * weights[v] / total
+		rem[v] = n * weights[v] % total
+		left -= out[v]
+	}
+	sort.SliceStable(values, func(i, j int) bool { return rem[values[i]] > rem[values[j]] })
+	for i := 0; i < left; i++ {
+		out[values[i]]++
+	}
+	for v, c := range out {
+		if c == 0 {
+			delete(out, v)
+		}
+	}
+	return out
+}
+
+func writeByTag(w io.Writer, key string, trs []tagReport, currency string) {
+	if len(trs) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "On-demand instances by tag %s:\n", key)
+	for _, t := range trs {
+		value := t.Value
+		if value == "" {
+			value = "(untagged)"
+		}
+		writeTagReport(w, key+"="+value, t, currency)
+	}
+}
+
+// writeTagReport writes on-demand instances attributed to group with label
+func writeTagReport(w io.Writer, label string, t tagReport, currency string) {
+	var cost string
+	if t.Cost > 0 {
+		cost = fmt.Sprintf("\t%s/month", money(t.Cost, currency))
+	}
+	fmt.Fprintf(w, "%s\t%d on-demand of %d running%s\n", label, t.OnDemand, t.Running, cost)
+	for _, v := range t.OnDemandInstances {
+		fmt.Fprintf(w, "  %s\t%d\t%s\t%s\t%s\n", v.Type, v.Count, v.AZ, v.Platform, v.Tenancy)
+	}
+}
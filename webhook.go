@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+// webhookTemplates are built-in webhook payload templates, they're rendered
+// over event value
+var webhookTemplates = map[string]string{
+	"json": `{{json .}}`,
+	"slack": `{"text": "*{{.Title}}* in {{.Region}} (account {{.Account}}): ` +
+		`{{.Uncovered}} on-demand instances, {{.Unused}} unused reservations, {{.Coverage}}% covered\n` +
+		`{{range .OnDemandInstances}}• on-demand {{row .}}: {{.Count}}\n{{end}}` +
+		`{{range .UnusedReservations}}• unused {{row .}}: {{.Count}}\n{{end}}"}`,
+	"teams": `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "themeColor": "FF8C00",
+"summary": "{{.Title}} in {{.Region}}",
+"title": "{{.Title}} in {{.Region}} (account {{.Account}})",
+"text": "{{.Uncovered}} on-demand instances, {{.Unused}} unused reservations, {{.Coverage}}% covered",
+"sections": [
+{"activityTitle": "On-demand instances", "facts": [{{range $i, $v := .OnDemandInstances}}{{if $i}}, {{end}}` +
+		`{"name": {{json (row $v)}}, "value": "{{$v.Count}}"}{{end}}]},
+{"activityTitle": "Unused reservations", "facts": [{{range $i, $v := .UnusedReservations}}{{if $i}}, {{end}}` +
+		`{"name": {{json (row $v)}}, "value": "{{$v.Count}}"}{{end}}]}
+]}`,
+}
+
+// loadWebhookTemplate returns template by built-in name or from named file
+func loadWebhookTemplate(name string) (*template.Template, error) {
+	text, ok := webhookTemplates[name]
+	if !ok {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"row": itemRow,
+	}).Parse(text)
+}
+
+// itemRow describes item in a single line: its type, AZ, platform and
+// tenancy, omitting empty ones
+func itemRow(it reservations.Item) string {
+	fields := []string{it.Type}
+	for _, s := range []string{it.AZ, it.Platform, it.Tenancy} {
+		if s != "" {
+			fields = append(fields, s)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// webhook describes HTTP endpoint notifications are POSTed to
+type webhook struct {
+	URL      string
+	Template string   // file name or built-in template name
+	Headers  []string // extra request headers in "Name: value" form
+	Retries  int      // number of retries on network errors and 429/5xx responses
+}
+
+// postWebhook renders payload from template over ev and POSTs it to webhook.
+// If hc is nil, client with default settings is used.
+func postWebhook(ctx context.Context, hc *http.Client, wh webhook, ev *event) error {
+	tpl, err := loadWebhookTemplate(wh.Template)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, ev); err != nil {
+		return err
+	}
+	if hc == nil {
+		hc = &http.Client{Timeout: time.Minute}
+	}
+	delay := time.Second
+	for i := 0; ; i++ {
+		retry, err := postOnce(ctx, hc, wh, buf.Bytes())
+		if err == nil || !retry || i >= wh.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// postOnce makes a single POST request, it reports whether failed request
+// may be retried
+func postOnce(ctx context.Context, hc *http.Client, wh webhook, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range wh.Headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return false, fmt.Errorf("invalid header %q, must be in \"Name: value\" form", h)
+		}
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("unexpected response status %q: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return false, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/artyom/ec2-reservations/reservations"
+)
+
+func TestWebhookTemplates(t *testing.T) {
+	ev := newEvent(&report{Service: "rds", Region: "us-east-1", Account: "123456789012", Result: reservations.Result{
+		Running: 3,
+		OnDemandInstances: []reservations.Item{
+			{Type: "db.r6g.large", AZ: "us-east-1a", Platform: "postgres", Count: 1},
+			{Type: "db.r6g.large", AZ: "us-east-1a", Platform: "mysql", Count: 1},
+		},
+		UnusedReservations: []reservations.Item{{Type: "db.t4g.small", Platform: "postgres", Scope: "Region", Count: 1}},
+	}}, 1)
+	for _, name := range []string{"json", "slack", "teams"} {
+		tpl, err := loadWebhookTemplate(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, ev); err != nil {
+			t.Fatal(err)
+		}
+		if !json.Valid(buf.Bytes()) {
+			t.Errorf("%s: invalid JSON: %s", name, buf.String())
+		}
+		if name == "json" {
+			continue
+		}
+		for _, s := range []string{"RDS reservations mismatch", "db.r6g.large us-east-1a postgres", "db.r6g.large us-east-1a mysql", "db.t4g.small postgres"} {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("%s: %q not found in %s", name, s, buf.String())
+			}
+		}
+		if strings.Contains(buf.String(), "EC2") {
+			t.Errorf("%s: RDS event mentions EC2: %s", name, buf.String())
+		}
+	}
+}